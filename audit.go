@@ -1,11 +1,16 @@
 package audit
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"path"
 	"regexp"
 	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -23,7 +28,7 @@ const (
 
 type Event struct {
 	ActorID    uint64    `db:"actor_id"`
-	TableRowID uint64    `db:"table_row_id"`
+	TableRowID string    `db:"table_row_id"`
 	Table      string    `db:"table_name"`
 	Action     Action    `db:"action"`
 	OldValues  string    `db:"old_values"`
@@ -34,27 +39,54 @@ type Event struct {
 	UserAgent  string    `db:"user_agent"`
 	CreatedAt  time.Time `db:"created_at"`
 
+	// PrevHash and Hash chain the event to the one before it, see WithHashChain
+	PrevHash string `db:"prev_hash"`
+	Hash     string `db:"hash"`
+	// KeyID and Signature sign the event, see WithSigning
+	KeyID     string `db:"key_id"`
+	Signature string `db:"signature"`
+
 	WhereClause WhereClause
 	IsExempted  bool
 }
 
 type Option func(*Auditor)
 
-var defaultAuditor = &Auditor{
-	auditTableName: "audits",
-	tableException: []string{"audits"},
+// defaultRowLimit is the most rows of a statement audited one by one
+const defaultRowLimit = 1000
+
+// defaultAuditor is a new auditor with the default settings
+func defaultAuditor() *Auditor {
+	return &Auditor{
+		auditTableName: "audits",
+		tableException: []string{"audits"},
+		store: store{
+			rowLimit:       defaultRowLimit,
+			discoveredKeys: &keyCache{},
+		},
+	}
 }
 
 // NewAudit created a new auditor instance
 func NewAudit(opts ...Option) (*Auditor, error) {
-	a := defaultAuditor
+	a := defaultAuditor()
 	for _, opt := range opts {
 		opt(a)
 	}
+	if a.err != nil {
+		return nil, a.err
+	}
 
 	return a, nil
 }
 
+// optionError keeps the first error of setting the options.
+func (a *Auditor) optionError(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
 // WithTableName customise the audit table name
 func WithTableName(tableName string) Option {
 	return func(a *Auditor) {
@@ -67,22 +99,163 @@ func WithTableName(tableName string) Option {
 	}
 }
 
-//func WithMongo(dsn string) Option {
-//	return func(a *Auditor) {
-//		client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(dsn))
-//		if err != nil {
-//			log.Fatal(err)
-//		}
-//		a.store.mongo = client
-//	}
-//}
-//
-//// WithQueue todo: Allow client to use existing queue to save into database
-//func WithQueue() Option {
-//	return func(a *Auditor) {
-//
-//	}
-//}
+// WithRowLimit caps the rows of a statement audited one by one, 0 for no
+// limit. A statement affecting more rows is saved as one summary event.
+func WithRowLimit(limit int) Option {
+	return func(a *Auditor) {
+		if limit < 0 {
+			limit = 0
+		}
+		a.store.rowLimit = limit
+	}
+}
+
+// WithPrimaryKey sets the primary key columns of a table
+func WithPrimaryKey(tableName string, columns ...string) Option {
+	return func(a *Auditor) {
+		if a.store.primaryKeys == nil {
+			a.store.primaryKeys = make(map[string][]string)
+		}
+		a.store.primaryKeys[strings.ToLower(tableName)] = columns
+	}
+}
+
+// WithPostImage records new values as the rows read after the write. Postgres
+// returns them through `RETURNING *`, while MySQL selects them again by id.
+func WithPostImage() Option {
+	return func(a *Auditor) {
+		a.store.postImage = true
+	}
+}
+
+// WithSameTransaction writes the audit rows of a transaction in it. It cannot
+// be used with WithHashChain, WithQueue or an audit database.
+func WithSameTransaction() Option {
+	return func(a *Auditor) {
+		a.store.sameTransaction = true
+	}
+}
+
+// WithErrorHandler is given the events not saved after their transaction
+// committed, and the SQLite statements run without being audited as they could
+// not be parsed
+func WithErrorHandler(fn func(err error, events []Event)) Option {
+	return func(a *Auditor) {
+		a.store.onError = fn
+	}
+}
+
+// WithConsistentPreImage reads old values on the statement's connection,
+// locking the rows. A statement run outside a transaction is given one.
+func WithConsistentPreImage() Option {
+	return func(a *Auditor) {
+		a.store.consistentPreImage = true
+	}
+}
+
+// WithSink saves events through the sink instead of the audit table. Events of
+// a transaction reach the sink once it commits.
+func WithSink(sink Sink) Option {
+	return func(a *Auditor) {
+		a.store.sink = sink
+	}
+}
+
+// WithQueue saves events in the background, in batches. Call Auditor.Close on
+// shutdown so that queued events are saved.
+func WithQueue(config QueueConfig) Option {
+	return func(a *Auditor) {
+		a.store.queueConfig = &config
+	}
+}
+
+// WithMongo saves events into a MongoDB collection instead of the audit table
+func WithMongo(dsn, database string) Option {
+	return func(a *Auditor) {
+		client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(dsn))
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.store.mongo = client
+		a.store.mongoDatabase = database
+	}
+}
+
+// WithHashChain links every event to the one before it by hash. Auditors
+// sharing the audit table take turns by locking it.
+func WithHashChain() Option {
+	return func(a *Auditor) {
+		a.store.hashChain = true
+	}
+}
+
+// WithSigning signs every event with the current key of the provider
+func WithSigning(keys KeyProvider) Option {
+	return func(a *Auditor) {
+		a.store.signingKeys = keys
+	}
+}
+
+// WithRedaction hides the values of sensitive columns
+func WithRedaction(rules ...RedactRule) Option {
+	return func(a *Auditor) {
+		for _, rule := range rules {
+			if _, err := path.Match(rule.Column, ""); err != nil {
+				a.optionError(fmt.Errorf("redaction of column %q: %w", rule.Column, err))
+				return
+			}
+			if rule.Action == RedactHash && len(rule.Salt) == 0 {
+				a.optionError(fmt.Errorf("redaction of column %q: %w", rule.Column, ErrRedactSalt))
+				return
+			}
+		}
+		a.store.redaction = append(a.store.redaction, rules...)
+	}
+}
+
+// WithEncryption encrypts the old and new values of the tables, or of every
+// table
+func WithEncryption(encrypter KeyEncrypter, tableNames ...string) Option {
+	tables := make([]string, 0, len(tableNames))
+	for _, name := range tableNames {
+		tables = append(tables, strings.ToLower(name))
+	}
+	return func(a *Auditor) {
+		if wrapper, ok := encrypter.(*KeyWrapper); ok {
+			if err := wrapper.checkKeys(); err != nil {
+				a.optionError(fmt.Errorf("encryption: %w", err))
+				return
+			}
+		}
+		a.store.encrypter = encrypter
+		a.store.encryptedTables = append(a.store.encryptedTables, tables...)
+	}
+}
+
+// WithFile saves events into JSON Lines files instead of the audit table
+func WithFile(config FileConfig) Option {
+	return func(a *Auditor) {
+		sink, err := NewFileSink(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.store.sink = sink
+	}
+}
+
+// WithPolicy sets what is audited of the tables the policies match. A table
+// is audited by the first policy matching it, and in full when none does.
+func WithPolicy(policies ...Policy) Option {
+	return func(a *Auditor) {
+		for _, policy := range policies {
+			if _, err := path.Match(policy.Table, ""); err != nil {
+				a.optionError(fmt.Errorf("policy of table %q: %w", policy.Table, err))
+				return
+			}
+		}
+		a.policies = append(a.policies, policies...)
+	}
+}
 
 // WithTableException list of tables not to be audited
 func WithTableException(tableNames ...string) Option {
@@ -95,12 +268,22 @@ func WithTableException(tableNames ...string) Option {
 	}
 }
 
-func isExempted(exception []string, tableName string) bool {
+// isExempted reports whether a table is one of the exceptions, in any schema
+// unless the exception names one
+func isExempted(exception []string, tableName, defaultSchema string) bool {
 	if tableName == "" {
 		return true
 	}
+	schema, name := splitTableName(tableName)
+	if schema == "" {
+		schema = defaultSchema
+	}
 	for _, table := range exception {
-		if tableName == table {
+		exceptSchema, exceptName := splitTableName(table)
+		if !strings.EqualFold(name, exceptName) {
+			continue
+		}
+		if exceptSchema == "" || strings.EqualFold(schema, exceptSchema) {
 			return true
 		}
 	}
@@ -108,6 +291,14 @@ func isExempted(exception []string, tableName string) bool {
 	return false
 }
 
+// splitTableName splits a `schema.table` name into its parts.
+func splitTableName(tableName string) (schema, name string) {
+	if i := strings.LastIndex(tableName, "."); i >= 0 {
+		return tableName[:i], tableName[i+1:]
+	}
+	return "", tableName
+}
+
 func sanitise(name string) (string, error) {
 	return onlyAlphaNumeric(name)
 }
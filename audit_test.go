@@ -1,21 +1,44 @@
 package audit
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/qustavo/sqlhooks/v2"
 	//pg_query "github.com/pganalyze/pg_query_go/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 )
 
 const (
 	CreateTablePostgres = `CREATE TABLE IF NOT EXISTS users (id bigserial primary key, email text null);`
 	CreateTableMysql    = `CREATE TABLE IF NOT EXISTS users( id bigint unsigned auto_increment primary key, email text null);`
+	CreateTableSqlite   = `CREATE TABLE IF NOT EXISTS users (id integer primary key autoincrement, email text null);`
 )
 
 type suite struct {
@@ -61,6 +84,14 @@ func TestPostgres(t *testing.T) {
 	s.TestInsertPostgres(t, "INSERT INTO users (email) VALUES ($1) RETURNING id", "email@example.com")
 	s.TestUpdate(t, "UPDATE users SET email=$1 where id=$2", 1, "edited@example.com")
 	s.TestDelete(t, "DELETE FROM users where id=$1", 1)
+	s.TestInsertPostgres(t, "INSERT INTO users (email) VALUES ($1) RETURNING id", "second@example.com")
+	s.TestInsertPostgres(t, "INSERT INTO users (email) VALUES ($1) RETURNING id", "third@example.com")
+	s.TestMany(t, Delete, "DELETE FROM users WHERE id = ANY($1)", 2, pq.Array([]int64{2, 3}))
+	s.TestInsertID(t, "INSERT INTO users (email) VALUES ($1)", "fourth@example.com", "4")
+	s.TestMany(t, Insert, "INSERT INTO users (email) VALUES ($1), ($2), ($3)", 3, "a@example.com", "b@example.com", "c@example.com")
+	s.TestInsertReturning(t, "INSERT INTO users (email) VALUES ($1) RETURNING email", "eighth@example.com", "8")
+	s.TestTransaction(t, "UPDATE users SET email=$1 where id=$2", 4, "committed@example.com")
+	s.TestConsistentPreImage(t, "UPDATE users SET email=$1 where id=$2", 4, "consistent@example.com")
 }
 
 func TestMysql(t *testing.T) {
@@ -80,6 +111,332 @@ func TestMysql(t *testing.T) {
 	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "email@example.com")
 	s.TestUpdate(t, "UPDATE users SET email=? where id=?", 1, "edited@example.com")
 	s.TestDelete(t, "DELETE FROM users where id=?", 1)
+	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "second@example.com")
+	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "third@example.com")
+	s.TestMany(t, Delete, "DELETE FROM users WHERE id IN (?, ?)", 2, 2, 3)
+	s.TestInsertID(t, "INSERT INTO users (email) VALUES(?)", "fourth@example.com", "4")
+	s.TestMany(t, Insert, "INSERT INTO users (email) VALUES (?), (?), (?)", 3, "a@example.com", "b@example.com", "c@example.com")
+	s.TestMany(t, Insert, "INSERT INTO users (email) SELECT email FROM users WHERE id IN (?, ?)", 2, 4, 6)
+	s.TestTransaction(t, "UPDATE users SET email=? where id=?", 4, "committed@example.com")
+	s.TestConsistentPreImage(t, "UPDATE users SET email=? where id=?", 4, "consistent@example.com")
+}
+
+func TestSqlite(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "audit_test.db")
+	setupTable(t, dsn, SqliteDB)
+
+	auditTableName := "audits"
+	s := newSqlSuite(t, "sqlite3", dsn, auditTableName)
+
+	s.TestFails(t, "INSERT INTO users (email) VALUES(?)", "email@example.com")
+	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "email@example.com")
+	s.TestUpdate(t, `UPDATE "users" SET email=? where id=?`, 1, "edited@example.com")
+	s.TestDelete(t, "DELETE FROM users where id=?", 1)
+	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "second@example.com")
+	s.TestInsert(t, "INSERT INTO users (email) VALUES(?)", "third@example.com")
+	s.TestMany(t, Delete, "DELETE FROM users WHERE id IN (?, ?)", 2, 2, 3)
+	s.TestInsertID(t, "INSERT INTO users (email) VALUES(?)", "fourth@example.com", "4")
+	s.TestMany(t, Insert, "INSERT INTO users (email) VALUES (?), (?), (?)", 3, "a@example.com", "b@example.com", "c@example.com")
+	s.TestInsertID(t, "INSERT INTO users (email) VALUES(?)", "eighth@example.com", "8")
+	s.TestMany(t, Update, "INSERT INTO users (id, email) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET email = excluded.email", 1, 4, "upserted@example.com")
+	s.TestMany(t, Update, "INSERT OR REPLACE INTO users (id, email) VALUES (?, ?)", 1, 5, "replaced@example.com")
+	s.TestMany(t, Insert, "INSERT INTO users (email) SELECT email FROM users WHERE id IN (?, ?)", 2, 4, 6)
+	s.TestTransaction(t, "UPDATE users SET email=? where id=?", 4, "committed@example.com")
+	s.TestConsistentPreImage(t, "UPDATE users SET email=? where id=?", 4, "consistent@example.com")
+}
+
+func TestSqliteSyntax(t *testing.T) {
+	var reported []error
+	auditor, err := NewAudit(WithErrorHandler(func(err error, events []Event) {
+		reported = append(reported, err)
+	}))
+	require.NoError(t, err)
+	db, _ := openSqlite(t, "syntax", auditor)
+
+	ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "POST"})
+	_, err = db.ExecContext(ctx, "INSERT INTO users DEFAULT VALUES")
+	require.NoError(t, err)
+
+	_, err = db.ExecContext(ctx, "UPDATE users SET email = n.email FROM (SELECT ? AS email) AS n WHERE users.id = ?", "a@example.com", 1)
+	require.NoError(t, err)
+
+	var email string
+	require.NoError(t, db.QueryRow("SELECT email FROM users WHERE id = 1").Scan(&email))
+	assert.Equal(t, "a@example.com", email)
+
+	require.Len(t, reported, 2)
+	for _, err := range reported {
+		assert.ErrorIs(t, err, ErrSqliteSyntax)
+	}
+
+	var audits int
+	require.NoError(t, auditor.store.internal.QueryRow("SELECT count(*) FROM audits").Scan(&audits))
+	assert.Equal(t, 0, audits)
+}
+
+func TestNewAuditDefaults(t *testing.T) {
+	a, err := NewAudit(WithTableException("except_table"), WithRowLimit(5))
+	assert.Nil(t, err)
+	b, err := NewAudit()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"audits"}, b.tableException)
+	assert.Equal(t, defaultRowLimit, b.rowLimit)
+	assert.NotSame(t, a.discoveredKeys, b.discoveredKeys)
+}
+
+func TestAuditDB(t *testing.T) {
+	auditor, err := NewAudit()
+	require.NoError(t, err)
+	db, _ := openSqlite(t, "audit-db", auditor, AuditDSN(SqliteDB, filepath.Join(t.TempDir(), "audit.db")))
+
+	ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "POST"})
+	_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", "a@example.com")
+	require.NoError(t, err)
+
+	var tables int
+	err = auditor.store.internal.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'audits'").Scan(&tables)
+	require.NoError(t, err)
+	assert.Equal(t, 0, tables)
+
+	var tableRowID, newValues string
+	err = auditor.store.auditDB.QueryRow("SELECT table_row_id, new_values FROM audits").Scan(&tableRowID, &newValues)
+	require.NoError(t, err)
+	assert.Equal(t, "1", tableRowID)
+	assert.JSONEq(t, `{"id":"1","email":"a@example.com"}`, newValues)
+}
+
+func TestMigrateAuditTable(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// as created before the hash and signature columns
+	_, err = db.Exec("CREATE TABLE audits (id integer primary key autoincrement, actor_id integer null, table_row_id text null, table_name text null, action varchar(10) null, old_values text null, new_values text null, http_method varchar(11) null, url text null, ip_address text null, user_agent text null, created_at datetime null)")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, migrateAuditTable(ctx, db, SqliteDB, "audits", true, true))
+	require.NoError(t, migrateAuditTable(ctx, db, SqliteDB, "audits", true, true))
+
+	_, err = db.Exec("INSERT INTO audits (prev_hash, hash, key_id, signature) VALUES ('', 'a', 'k1', 'b')")
+	require.NoError(t, err)
+}
+
+func TestHashChain(t *testing.T) {
+	auditor, err := NewAudit(WithHashChain())
+	require.NoError(t, err)
+	db, dsn := openSqlite(t, "hash-chain", auditor)
+
+	ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "POST"})
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", email)
+		require.NoError(t, err)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE users SET email = ? WHERE id = ?", "d@example.com", 2)
+	require.NoError(t, err)
+
+	require.NoError(t, auditor.Verify(ctx, 1, 0))
+	require.NoError(t, auditor.Verify(ctx, 3, 4))
+
+	var prevHash string
+	err = auditor.store.internal.QueryRow("SELECT prev_hash FROM audits WHERE id = 1").Scan(&prevHash)
+	require.NoError(t, err)
+	assert.Equal(t, "", prevHash)
+
+	t.Run("several writers", func(t *testing.T) {
+		// another auditor writing to the same table, such as another instance
+		internal, err := sql.Open("sqlite3", dsn)
+		require.NoError(t, err)
+		defer internal.Close()
+		sink, ok := auditor.store.tableSink()
+		require.True(t, ok)
+		other := newSqlSink(internal, SqliteDB, sink.table, sink.insert)
+		other.hashed = true
+
+		createdAt := time.Date(2021, 3, 4, 5, 6, 7, 800, time.UTC)
+		for i, s := range []Sink{auditor.store.sink, newChainSink(other), auditor.store.sink} {
+			events := []Event{{Table: "users", Action: Insert, TableRowID: strconv.Itoa(i), CreatedAt: createdAt}}
+			require.NoError(t, s.Write(ctx, events))
+			assert.Equal(t, createdAt, events[0].CreatedAt)
+		}
+
+		require.NoError(t, auditor.Verify(ctx, 1, 0))
+	})
+
+	t.Run("altered", func(t *testing.T) {
+		_, err := auditor.store.internal.Exec("UPDATE audits SET new_values = ? WHERE id = 2", `{"id":"2","email":"e@example.com"}`)
+		require.NoError(t, err)
+
+		err = auditor.Verify(ctx, 1, 0)
+		assert.Equal(t, &ChainError{ID: 2, Reason: "record does not match its hash"}, err)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		_, err := auditor.store.internal.Exec("DELETE FROM audits WHERE id = 2")
+		require.NoError(t, err)
+
+		err = auditor.Verify(ctx, 3, 0)
+		assert.Equal(t, &ChainError{ID: 3, Reason: "record does not follow the one before it"}, err)
+	})
+
+	t.Run("other sinks", func(t *testing.T) {
+		sink, err := NewFileSink(FileConfig{Dir: t.TempDir()})
+		require.NoError(t, err)
+		defer sink.Close()
+
+		s := store{hashChain: true, sink: sink}
+		assert.ErrorIs(t, s.chainSink(), ErrHashChainNotSupported)
+	})
+
+	t.Run("time as text", func(t *testing.T) {
+		want := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		for _, src := range []interface{}{[]byte("2021-03-04 05:06:07"), "2021-03-04T05:06:07Z", want} {
+			var got scannedTime
+			require.NoError(t, got.Scan(src))
+			assert.True(t, want.Equal(got.Time), src)
+		}
+	})
+}
+
+func TestSigning(t *testing.T) {
+	first := "first=" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	second := "second=" + base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+
+	t.Run("parse keys", func(t *testing.T) {
+		ring, err := ParseKeys("# rotated yearly\n" + first + "\n\n" + second + "\n")
+		require.NoError(t, err)
+		id, key, err := ring.CurrentKey(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "second", id)
+		assert.Equal(t, []byte("fedcba9876543210"), key)
+
+		_, err = ParseKeys("")
+		assert.Equal(t, ErrNoSigningKeys, err)
+		_, err = ParseKeys("short=" + base64.StdEncoding.EncodeToString([]byte("key")))
+		assert.ErrorIs(t, err, ErrShortSigningKey)
+		_, err = ParseKeys("=" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")))
+		assert.Equal(t, ErrInvalidSigningKeys, err)
+	})
+
+	ring, err := ParseKeys(first)
+	require.NoError(t, err)
+	auditor, err := NewAudit(WithSigning(ring))
+	require.NoError(t, err)
+	db, _ := openSqlite(t, "signing", auditor)
+
+	ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "POST"})
+	_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", "a@example.com")
+	require.NoError(t, err)
+
+	// rotated, keeping the first key to verify the record it signed
+	auditor.store.signingKeys, err = ParseKeys(first + "," + second)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", "b@example.com")
+	require.NoError(t, err)
+
+	var keyIDs []string
+	rows, err := auditor.store.internal.Query("SELECT key_id FROM audits ORDER BY id")
+	require.NoError(t, err)
+	for rows.Next() {
+		var keyID string
+		require.NoError(t, rows.Scan(&keyID))
+		keyIDs = append(keyIDs, keyID)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"first", "second"}, keyIDs)
+
+	require.NoError(t, auditor.VerifySignatures(ctx, 1, 0))
+
+	t.Run("created at", func(t *testing.T) {
+		createdAt := time.Date(2021, 3, 4, 5, 6, 7, 800, time.UTC)
+		events := []Event{{Table: "users", CreatedAt: createdAt}}
+		require.NoError(t, auditor.store.sign(ctx, events))
+		assert.Equal(t, createdAt, events[0].CreatedAt)
+
+		// as read back from an audit table that keeps whole seconds
+		events[0].CreatedAt = createdAt.Truncate(time.Second)
+		assert.NoError(t, auditor.VerifySignature(ctx, events[0]))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		keys := auditor.store.signingKeys
+		defer func() { auditor.store.signingKeys = keys }()
+		auditor.store.signingKeys, err = ParseKeys(second)
+		require.NoError(t, err)
+
+		err = auditor.VerifySignatures(ctx, 1, 0)
+		assert.Equal(t, &SignatureError{ID: 1, KeyID: "first", Reason: "key is not known"}, err)
+	})
+
+	t.Run("altered", func(t *testing.T) {
+		_, err := auditor.store.internal.Exec("UPDATE audits SET actor_id = 2 WHERE id = 2")
+		require.NoError(t, err)
+
+		err = auditor.VerifySignatures(ctx, 1, 0)
+		assert.Equal(t, &SignatureError{ID: 2, KeyID: "second", Reason: "record does not match its signature"}, err)
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	ring, err := ParseKeys("kek=" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")))
+	require.NoError(t, err)
+	auditor, err := NewAudit(WithEncryption(NewKeyWrapper(ring), "users"))
+	require.NoError(t, err)
+	db, _ := openSqlite(t, "encryption", auditor)
+
+	_, err = db.Exec("CREATE TABLE orders (id integer primary key autoincrement, total text null)")
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "POST"})
+	_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", "a@example.com")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO users (email) VALUES (?)", "b@example.com")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO orders (total) VALUES (?)", "10")
+	require.NoError(t, err)
+
+	var tableName, tableRowID, oldValues, newValues string
+	err = auditor.store.internal.QueryRow("SELECT table_name, table_row_id, old_values, new_values FROM audits WHERE id = 1").Scan(&tableName, &tableRowID, &oldValues, &newValues)
+	require.NoError(t, err)
+	assert.Equal(t, "users", tableName)
+	assert.Equal(t, "1", tableRowID)
+	assert.Equal(t, "{}", oldValues)
+	assert.Contains(t, newValues, `"_encrypted"`)
+	assert.NotContains(t, newValues, "a@example.com")
+
+	records, err := auditor.Records(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, int64(1), records[0].ID)
+	assert.JSONEq(t, `{"id":"1","email":"a@example.com"}`, records[0].NewValues)
+	assert.JSONEq(t, `{"id":"2","email":"b@example.com"}`, records[1].NewValues)
+	assert.JSONEq(t, `{"id":"1","total":"10"}`, records[2].NewValues)
+
+	t.Run("moved", func(t *testing.T) {
+		_, err := auditor.store.internal.Exec("UPDATE audits SET new_values = (SELECT new_values FROM audits WHERE id = 1) WHERE id = 2")
+		require.NoError(t, err)
+
+		_, err = auditor.Records(ctx, 2, 2)
+		assert.Error(t, err)
+	})
+
+	t.Run("key size", func(t *testing.T) {
+		signing, err := ParseKeys("k1=" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123")))
+		require.NoError(t, err)
+		_, err = NewAudit(WithEncryption(NewKeyWrapper(signing)))
+		assert.ErrorIs(t, err, ErrKeySize)
+		_, err = NewAudit(WithEncryption(NewKeyWrapper(ring)))
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		other, err := ParseKeys("other=" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")))
+		require.NoError(t, err)
+
+		_, err = Decrypt(ctx, NewKeyWrapper(other), Event{Table: "users", TableRowID: "1", Action: Insert, NewValues: newValues})
+		assert.Equal(t, ErrUnknownSigningKey, err)
+	})
 }
 
 func (s *suite) TestFails(t *testing.T, query string, arg0 string) {
@@ -128,6 +485,65 @@ func (s *suite) TestInsertPostgres(t *testing.T, query string, args ...interface
 	})
 }
 
+func (s *suite) TestInsertID(t *testing.T, query string, email string, id string) {
+	ctx := context.Background()
+
+	t.Run("insert id", func(t *testing.T) {
+		ctx = context.WithValue(ctx, "userID", uint64(1))
+		event := Event{
+			HTTPMethod: "POST",
+			URL:        "https://site.test/api/user",
+			IPAddress:  "127.0.0.1",
+			UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20100101 Firefox/10.0",
+		}
+
+		ctx := context.WithValue(ctx, "audit", event)
+		_, err := s.db.ExecContext(ctx, query, email)
+		assert.NoError(t, err)
+
+		var tableRowID string
+		q := fmt.Sprintf("SELECT table_row_id FROM %s WHERE action = 'insert' ORDER BY id DESC LIMIT 1", s.auditor.auditTableName)
+		err = s.auditor.store.internal.QueryRowContext(context.Background(), q).Scan(&tableRowID)
+		assert.NoError(t, err)
+		assert.Equal(t, id, tableRowID)
+	})
+}
+
+func (s *suite) TestInsertReturning(t *testing.T, query string, email string, id string) {
+	ctx := context.Background()
+
+	t.Run("insert returning", func(t *testing.T) {
+		ctx = context.WithValue(ctx, "userID", uint64(1))
+		event := Event{
+			HTTPMethod: "POST",
+			URL:        "https://site.test/api/user",
+			IPAddress:  "127.0.0.1",
+			UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20100101 Firefox/10.0",
+		}
+
+		// the id the auditor adds to the RETURNING clause is hidden from the
+		// application
+		ctx := context.WithValue(ctx, "audit", event)
+		rows, err := s.db.QueryContext(ctx, query, email)
+		require.NoError(t, err)
+		columns, err := rows.Columns()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"email"}, columns)
+		var returned string
+		for rows.Next() {
+			assert.NoError(t, rows.Scan(&returned))
+		}
+		assert.NoError(t, rows.Close())
+		assert.Equal(t, email, returned)
+
+		var tableRowID string
+		q := fmt.Sprintf("SELECT table_row_id FROM %s WHERE action = 'insert' ORDER BY id DESC LIMIT 1", s.auditor.auditTableName)
+		err = s.auditor.store.internal.QueryRowContext(context.Background(), q).Scan(&tableRowID)
+		assert.NoError(t, err)
+		assert.Equal(t, id, tableRowID)
+	})
+}
+
 func (s *suite) TestUpdate(t *testing.T, query string, id int, email string) {
 	ctx := context.Background()
 
@@ -163,6 +579,101 @@ func (s *suite) TestDelete(t *testing.T, query string, id int) {
 	})
 }
 
+func (s *suite) TestMany(t *testing.T, action Action, query string, affected int, args ...interface{}) {
+	ctx := context.Background()
+	t.Run(fmt.Sprintf("%s many", action), func(t *testing.T) {
+		ctx = context.WithValue(ctx, "userID", uint64(1))
+		event := Event{
+			HTTPMethod: "POST",
+			URL:        "https://site.test/api/user",
+			IPAddress:  "127.0.0.1",
+			UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20100101 Firefox/10.0",
+		}
+		ctx := context.WithValue(ctx, "audit", event)
+
+		before := s.countAudits(t, action)
+		_, err := s.db.ExecContext(ctx, query, args...)
+		assert.NoError(t, err)
+		assert.Equal(t, before+affected, s.countAudits(t, action))
+	})
+}
+
+func (s *suite) TestTransaction(t *testing.T, query string, id int, email string) {
+	ctx := context.Background()
+	t.Run("transaction", func(t *testing.T) {
+		ctx = context.WithValue(ctx, "userID", uint64(1))
+		event := Event{
+			HTTPMethod: "PUT",
+			URL:        "https://site.test/api/user/1",
+			IPAddress:  "127.0.0.1",
+			UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20100101 Firefox/10.0",
+		}
+		ctx := context.WithValue(ctx, "audit", event)
+
+		before := s.countAudits(t, Update)
+		tx, err := s.db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+		_, err = tx.ExecContext(ctx, query, email, id)
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Rollback())
+		assert.Equal(t, before, s.countAudits(t, Update))
+
+		tx, err = s.db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+		_, err = tx.ExecContext(ctx, query, email, id)
+		assert.NoError(t, err)
+		assert.Equal(t, before, s.countAudits(t, Update))
+		assert.NoError(t, tx.Commit())
+		assert.Equal(t, before+1, s.countAudits(t, Update))
+	})
+}
+
+func (s *suite) TestConsistentPreImage(t *testing.T, query string, id int, email string) {
+	ctx := context.Background()
+	t.Run("consistent pre-image", func(t *testing.T) {
+		s.auditor.store.consistentPreImage = true
+		defer func() { s.auditor.store.consistentPreImage = false }()
+
+		ctx = context.WithValue(ctx, "userID", uint64(1))
+		event := Event{
+			HTTPMethod: "PUT",
+			URL:        "https://site.test/api/user/1",
+			IPAddress:  "127.0.0.1",
+			UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20100101 Firefox/10.0",
+		}
+		ctx := context.WithValue(ctx, "audit", event)
+
+		var old string
+		q := fmt.Sprintf("SELECT email FROM users WHERE id = %d", id)
+		require.NoError(t, s.auditor.store.internal.QueryRowContext(context.Background(), q).Scan(&old))
+
+		// run outside a transaction, so the auditor begins one of its own
+		_, err := s.db.ExecContext(ctx, query, email, id)
+		assert.NoError(t, err)
+
+		var oldValues, newValues string
+		q = fmt.Sprintf("SELECT old_values, new_values FROM %s WHERE action = 'update' ORDER BY id DESC LIMIT 1", s.auditor.auditTableName)
+		err = s.auditor.store.internal.QueryRowContext(context.Background(), q).Scan(&oldValues, &newValues)
+		assert.NoError(t, err)
+		assert.Contains(t, oldValues, old)
+		assert.Contains(t, newValues, email)
+
+		var got string
+		q = fmt.Sprintf("SELECT email FROM users WHERE id = %d", id)
+		require.NoError(t, s.auditor.store.internal.QueryRowContext(context.Background(), q).Scan(&got))
+		assert.Equal(t, email, got)
+	})
+}
+
+func (s *suite) countAudits(t *testing.T, action Action) int {
+	var count int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE action = '%s'", s.auditor.auditTableName, action)
+	err := s.auditor.store.internal.QueryRowContext(context.Background(), query).Scan(&count)
+	assert.NoError(t, err)
+
+	return count
+}
+
 func (s *suite) CleanUp(t *testing.T, query string) {
 	ctx := context.Background()
 	_, err := s.auditor.store.internal.ExecContext(ctx, query)
@@ -205,6 +716,11 @@ func newSqlSuite(t *testing.T, driver string, dsn string, auditTableName string)
 		assert.NoError(t, err)
 
 		//suite.setInternalDB(t, "mysql", dsn) // only for testing purpose
+	} else if driver == "sqlite3" {
+		err = auditor.SetDB(
+			Sqlite(db, dsn),
+		)
+		assert.NoError(t, err)
 	}
 
 	return suite
@@ -226,9 +742,33 @@ func setupTable(t *testing.T, dsn, dbType string) {
 		defer db.Close()
 		_, err = db.Exec(CreateTablePostgres)
 		require.NoError(t, err)
+	case SqliteDB:
+		db, err := sql.Open("sqlite3", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Exec(CreateTableSqlite)
+		require.NoError(t, err)
 	}
 }
 
+// openSqlite opens a new SQLite database with the users table, audited by the
+// auditor under a driver of the name. Both are closed once the test ends.
+func openSqlite(t *testing.T, name string, auditor *Auditor, opts ...DBOption) (*sql.DB, string) {
+	dsn := filepath.Join(t.TempDir(), "app.db")
+	setupTable(t, dsn, SqliteDB)
+
+	driverName := "store-hooks-sqlite3-" + name
+	sql.Register(driverName, &transactionDriver{Driver: sqlhooks.Wrap(&sqlite3.SQLiteDriver{}, &Hooks{Auditor: auditor}), auditor: auditor})
+
+	db, err := sql.Open(driverName, dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, auditor.SetDB(append(opts, Sqlite(db, dsn))...))
+	t.Cleanup(func() { auditor.Close(context.Background()) })
+
+	return db, dsn
+}
+
 //// setInternalDB runs sql query without entering hooks.
 //func (s *suite) setInternalDB(t *testing.T, dbType string, dsn string) {
 //	if dbType == "mysql" {
@@ -245,3 +785,690 @@ func setupTable(t *testing.T, dsn, dbType string) {
 //		// internal store can be different from *sql.DB.
 //	}
 //}
+
+func TestIsExempted(t *testing.T) {
+	exception := []string{"audits", "billing.invoices", "public.sessions"}
+
+	tests := []struct {
+		tableName string
+		want      bool
+	}{
+		{tableName: "audits", want: true},
+		{tableName: "archive.audits", want: true},
+		{tableName: "billing.invoices", want: true},
+		{tableName: "invoices", want: false},
+		{tableName: "sessions", want: true},
+		{tableName: "public.Sessions", want: true},
+		{tableName: "other.sessions", want: false},
+		{tableName: "users", want: false},
+		{tableName: "", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tableName, func(t *testing.T) {
+			assert.Equal(t, tt.want, isExempted(exception, tt.tableName, "public"))
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	s := store{
+		defaultSchema: "public",
+		redaction: []RedactRule{
+			{Table: "users", Column: "password", Action: RedactDrop},
+			{Column: "*_TOKEN", Action: RedactMask},
+			{Table: "public.users", Column: "national_id", Action: RedactLast, Keep: 4},
+			{Column: "email", Action: RedactHash, Salt: []byte("salt")},
+		},
+	}
+	hashed := func(value string) string {
+		mac := hmac.New(sha256.New, []byte("salt"))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name  string
+		event Event
+		want  Event
+	}{
+		{
+			name: "insert",
+			event: Event{
+				Table:     "users",
+				Action:    Insert,
+				OldValues: "{}",
+				NewValues: `{"id":"1","password":"secret","reset_token":"abc","national_id":"900101145678","email":"a@example.com"}`,
+			},
+			want: Event{
+				Table:     "users",
+				Action:    Insert,
+				OldValues: "{}",
+				NewValues: `{"id":"1","reset_token":"[REDACTED]","national_id":"5678","email":"` + hashed("a@example.com") + `","_redacted":["password","reset_token","national_id","email"]}`,
+			},
+		},
+		{
+			name: "update",
+			event: Event{
+				Table:     "public.users",
+				Action:    Update,
+				OldValues: `{"id":"1","password":"secret","reset_token":null}`,
+				NewValues: `{"id":"1","password":"changed","reset_token":null}`,
+			},
+			want: Event{
+				Table:     "public.users",
+				Action:    Update,
+				OldValues: `{"id":"1","reset_token":null}`,
+				NewValues: `{"id":"1","reset_token":null,"_redacted":["password"]}`,
+			},
+		},
+		{
+			name: "unchanged number",
+			event: Event{
+				Table:     "users",
+				Action:    Update,
+				OldValues: `{"id":"1","national_id":"900101145678","reset_token":null}`,
+				NewValues: `{"id":"1","national_id":900101145678,"reset_token":null}`,
+			},
+			want: Event{
+				Table:     "users",
+				Action:    Update,
+				OldValues: `{"id":"1","national_id":"5678","reset_token":null}`,
+				NewValues: `{"id":"1","national_id":"5678","reset_token":null}`,
+			},
+		},
+		{
+			name: "delete",
+			event: Event{
+				Table:     "sessions",
+				Action:    Delete,
+				OldValues: `{"id":"1","password":"kept","access_token":"abc"}`,
+				NewValues: "{}",
+			},
+			want: Event{
+				Table:     "sessions",
+				Action:    Delete,
+				OldValues: `{"id":"1","password":"kept","access_token":"[REDACTED]","_redacted":["access_token"]}`,
+				NewValues: "{}",
+			},
+		},
+		{
+			name: "no match",
+			event: Event{
+				Table:     "orders",
+				Action:    Update,
+				OldValues: `{"id": "1", "total": "10"}`,
+				NewValues: `{"id": "1", "total": "12"}`,
+			},
+			want: Event{
+				Table:     "orders",
+				Action:    Update,
+				OldValues: `{"id": "1", "total": "10"}`,
+				NewValues: `{"id": "1", "total": "12"}`,
+			},
+		},
+		{
+			name: "not an object",
+			event: Event{
+				Table:     "users",
+				Action:    Insert,
+				OldValues: "{}",
+				NewValues: `["a@example.com"]`,
+			},
+			want: Event{
+				Table:     "users",
+				Action:    Insert,
+				OldValues: "{}",
+				NewValues: `{"_redacted":"[REDACTED]"}`,
+			},
+		},
+		{
+			name: "summary",
+			event: Event{
+				Table:       "users",
+				Action:      Update,
+				OldValues:   "{}",
+				NewValues:   `{"query":"UPDATE users SET email = 'a@example.com'","rows_affected":5000}`,
+				WhereClause: WhereClause{truncated: true},
+			},
+			want: Event{
+				Table:       "users",
+				Action:      Update,
+				OldValues:   "{}",
+				NewValues:   `{"query":"[REDACTED]","rows_affected":5000}`,
+				WhereClause: WhereClause{truncated: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := []Event{tt.event}
+			s.redact(events)
+			assert.Equal(t, tt.want, events[0])
+		})
+	}
+
+	t.Run("invalid rules", func(t *testing.T) {
+		_, err := NewAudit(WithRedaction(RedactRule{Column: "[", Action: RedactDrop}))
+		assert.ErrorIs(t, err, path.ErrBadPattern)
+
+		_, err = NewAudit(WithRedaction(RedactRule{Column: "email", Action: RedactHash}))
+		assert.ErrorIs(t, err, ErrRedactSalt)
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	a := &Auditor{
+		policies: []Policy{
+			{Table: "logs", Actions: []Action{Delete}},
+			{Table: "users", Actions: []Action{Insert, Update}, IgnoreColumns: []string{"last_seen_at"}},
+			{Table: "billing.*"},
+			{Table: "tmp_*", Exclude: true},
+		},
+		store: store{defaultSchema: "public"},
+	}
+
+	t.Run("audited", func(t *testing.T) {
+		tests := []struct {
+			tableName string
+			action    Action
+			want      bool
+		}{
+			{tableName: "logs", action: Delete, want: true},
+			{tableName: "logs", action: Insert, want: false},
+			{tableName: "public.LOGS", action: Update, want: false},
+			{tableName: "users", action: Update, want: true},
+			{tableName: "users", action: Delete, want: false},
+			{tableName: "billing.invoices", action: Delete, want: true},
+			{tableName: "tmp_import", action: Insert, want: false},
+			{tableName: "other.tmp_import", action: Insert, want: false},
+			{tableName: "orders", action: Delete, want: true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.tableName+" "+string(tt.action), func(t *testing.T) {
+				assert.Equal(t, tt.want, a.audited(tt.tableName, tt.action))
+			})
+		}
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		_, err := NewAudit(WithPolicy(Policy{Table: "tmp_["}))
+		assert.ErrorIs(t, err, path.ErrBadPattern)
+	})
+
+	t.Run("ignore columns", func(t *testing.T) {
+		events := a.applyPolicies([]Event{
+			{Table: "users", Action: Update, OldValues: `{"id":"1","email":"a@example.com","last_seen_at":"1"}`, NewValues: `{"last_seen_at":"2"}`},
+			{Table: "users", Action: Update, OldValues: `{"id":"1","email":"a@example.com","last_seen_at":"1"}`, NewValues: `{"email":"b@example.com","last_seen_at":"2"}`},
+			{Table: "users", Action: Update, OldValues: `{"id":"1","visits":"5","last_seen_at":"1"}`, NewValues: `{"id":"1","visits":5,"last_seen_at":"2"}`},
+			{Table: "users", Action: Delete, OldValues: `{"id":"1"}`, NewValues: "{}"},
+			{Table: "users", Action: Insert, OldValues: "{}", NewValues: `{"id":"2","last_seen_at":"2"}`},
+		}, "public")
+
+		assert.Equal(t, []Event{
+			{Table: "users", Action: Update, OldValues: `{"id":"1","email":"a@example.com"}`, NewValues: `{"email":"b@example.com"}`},
+			{Table: "users", Action: Insert, OldValues: "{}", NewValues: `{"id":"2"}`},
+		}, events)
+	})
+
+	t.Run("before", func(t *testing.T) {
+		auditor, err := NewAudit(WithPolicy(Policy{Table: "users", Actions: []Action{Delete}}))
+		require.NoError(t, err)
+		db, _ := openSqlite(t, "policy", auditor)
+
+		// not audited, so the audit event is not needed either
+		_, err = db.Exec("INSERT INTO users (email) VALUES (?)", "a@example.com")
+		require.NoError(t, err)
+
+		ctx := context.WithValue(context.Background(), "audit", Event{HTTPMethod: "DELETE"})
+		_, err = db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", 1)
+		require.NoError(t, err)
+
+		var actions []string
+		rows, err := auditor.store.internal.Query("SELECT action FROM audits ORDER BY id")
+		require.NoError(t, err)
+		for rows.Next() {
+			var action string
+			require.NoError(t, rows.Scan(&action))
+			actions = append(actions, action)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []string{"delete"}, actions)
+	})
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	events := []Event{{TableRowID: "1"}, {TableRowID: "2"}, {TableRowID: "3"}}
+
+	t.Run("batches", func(t *testing.T) {
+		sink := &recordSink{}
+		q, err := newQueue(sink, QueueConfig{BatchSize: 2, FlushInterval: time.Hour})
+		require.NoError(t, err)
+		require.NoError(t, q.Write(ctx, events))
+		require.NoError(t, q.Close(ctx))
+
+		assert.Equal(t, events, sink.events)
+		assert.Equal(t, 2, sink.batches)
+		assert.ErrorIs(t, q.Write(ctx, events), ErrQueueClosed)
+	})
+
+	t.Run("flush interval", func(t *testing.T) {
+		sink := &recordSink{}
+		q, err := newQueue(sink, QueueConfig{FlushInterval: time.Millisecond})
+		require.NoError(t, err)
+		require.NoError(t, q.Write(ctx, events[:1]))
+
+		assert.Eventually(t, func() bool {
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			return len(sink.events) == 1
+		}, time.Second, time.Millisecond)
+		require.NoError(t, q.Close(ctx))
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		q := &queue{config: QueueConfig{Policy: QueueDrop}, events: make(chan Event, 1)}
+		require.NoError(t, q.Write(ctx, events))
+
+		assert.Len(t, q.events, 1)
+		assert.Equal(t, uint64(2), q.dropped)
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		spill := &recordSink{}
+		q := &queue{config: QueueConfig{Policy: QueueSpill, Spill: spill}, events: make(chan Event, 1)}
+		require.NoError(t, q.Write(ctx, events))
+
+		assert.Len(t, q.events, 1)
+		assert.Equal(t, events[1:], spill.events)
+	})
+
+	t.Run("failed batch", func(t *testing.T) {
+		spill := &recordSink{}
+		var failed []Event
+		q, err := newQueue(failingSink{}, QueueConfig{MaxRetries: 1, Spill: spill, OnError: func(err error, events []Event) {
+			failed = events
+		}})
+		require.NoError(t, err)
+		require.NoError(t, q.Write(ctx, events))
+		require.NoError(t, q.Close(ctx))
+
+		assert.Equal(t, events, spill.events)
+		assert.Empty(t, failed)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		q := &queue{config: QueueConfig{Policy: QueueBlock}, events: make(chan Event, 1)}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, q.Write(ctx, events), context.DeadlineExceeded)
+	})
+
+	t.Run("no spill sink", func(t *testing.T) {
+		_, err := newQueue(&recordSink{}, QueueConfig{Policy: QueueSpill})
+		assert.ErrorIs(t, err, ErrNoSpillSink)
+	})
+
+	t.Run("close with a stuck sink", func(t *testing.T) {
+		release := make(chan struct{})
+		q, err := newQueue(stuckSink(release), QueueConfig{Size: 1, BatchSize: 1})
+		require.NoError(t, err)
+		// the sink holds the first event and the queue the second, so the
+		// third waits for room
+		go func() { _ = q.Write(ctx, events) }()
+		time.Sleep(10 * time.Millisecond)
+
+		closing, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, q.Close(closing), context.DeadlineExceeded)
+
+		close(release)
+		require.NoError(t, q.Close(ctx))
+	})
+}
+
+func TestInsertRows(t *testing.T) {
+	mysql := newSqlSink(nil, MysqlDB, "audits", fmt.Sprintf(MysqlInsert, "audits"))
+	assert.Equal(t, fmt.Sprintf(MysqlInsert, "audits"), mysql.insertRows(1))
+	assert.Equal(t, "INSERT INTO audits (actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?),(?,?,?,?,?,?,?,?,?,?,?)", mysql.insertRows(2))
+
+	postgres := newSqlSink(nil, PostgresDB, "audits", fmt.Sprintf(PostgresInsert, "audits"))
+	assert.Equal(t, "INSERT INTO audits (actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at) "+
+		"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11),($12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22)", postgres.insertRows(2))
+
+	assert.Len(t, batches(make([]Event, 1001), maxInsertRows), 3)
+}
+
+func TestMongoDocument(t *testing.T) {
+	doc, err := mongoDocument(Event{
+		TableRowID: "42",
+		Table:      "users",
+		Action:     Update,
+		OldValues:  `{"name":"test name","id":"42"}`,
+		NewValues:  `{"name":"changed name","id":"42"}`,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, bson.D{{Key: "name", Value: "test name"}, {Key: "id", Value: "42"}}, doc.OldValues)
+	assert.Equal(t, bson.D{{Key: "name", Value: "changed name"}, {Key: "id", Value: "42"}}, doc.NewValues)
+
+	doc, err = mongoDocument(Event{Action: Delete, OldValues: `{"id":"42"}`})
+	require.NoError(t, err)
+	assert.Equal(t, bson.D{}, doc.NewValues)
+
+	_, err = mongoDocument(Event{OldValues: "not json"})
+	assert.Error(t, err)
+}
+
+func TestMongoMonitorEvents(t *testing.T) {
+	ctx := context.Background()
+	m := &MongoMonitor{auditor: &Auditor{}}
+	oid := primitive.NewObjectID()
+
+	command := func(doc bson.D) bson.Raw {
+		raw, err := bson.Marshal(doc)
+		require.NoError(t, err)
+		return raw
+	}
+
+	t.Run("insert", func(t *testing.T) {
+		cmd := &mongoCommand{
+			event: Event{ActorID: 2, Table: "users"},
+			name:  "insert",
+			command: command(bson.D{
+				{Key: "insert", Value: "users"},
+				{Key: "ordered", Value: false},
+				{Key: "documents", Value: bson.A{
+					bson.D{{Key: "_id", Value: oid}, {Key: "name", Value: "a"}},
+					bson.D{{Key: "_id", Value: "b"}, {Key: "name", Value: "b"}},
+					bson.D{{Key: "_id", Value: int32(3)}, {Key: "name", Value: "c"}},
+				}},
+			}),
+		}
+		reply := command(bson.D{{Key: "n", Value: 2}, {Key: "writeErrors", Value: bson.A{bson.D{{Key: "index", Value: 1}}}}})
+
+		events, err := m.newEvents(ctx, cmd, reply)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, Insert, events[0].Action)
+		assert.Equal(t, uint64(2), events[0].ActorID)
+		assert.Equal(t, oid.Hex(), events[0].TableRowID)
+		assert.JSONEq(t, `{"_id":{"$oid":"`+oid.Hex()+`"},"name":"a"}`, events[0].NewValues)
+		assert.Equal(t, "3", events[1].TableRowID)
+	})
+
+	t.Run("ordered insert", func(t *testing.T) {
+		cmd := &mongoCommand{
+			event: Event{Table: "users"},
+			name:  "insert",
+			command: command(bson.D{
+				{Key: "insert", Value: "users"},
+				{Key: "documents", Value: bson.A{
+					bson.D{{Key: "_id", Value: "a"}},
+					bson.D{{Key: "_id", Value: "b"}},
+					bson.D{{Key: "_id", Value: "c"}},
+				}},
+			}),
+		}
+		reply := command(bson.D{{Key: "n", Value: 1}, {Key: "writeErrors", Value: bson.A{bson.D{{Key: "index", Value: 1}}}}})
+
+		events, err := m.newEvents(ctx, cmd, reply)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "a", events[0].TableRowID)
+	})
+
+	t.Run("no audit set", func(t *testing.T) {
+		m := &MongoMonitor{auditor: &Auditor{}, pending: make(map[int64]*mongoCommand)}
+		m.started(ctx, &event.CommandStartedEvent{
+			Command:     command(bson.D{{Key: "insert", Value: "users"}}),
+			CommandName: "insert",
+			RequestID:   1,
+		})
+		assert.Empty(t, m.pending)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		cmd := &mongoCommand{
+			event:   Event{Table: "users"},
+			name:    "delete",
+			command: command(bson.D{{Key: "delete", Value: "users"}}),
+			before:  []bson.Raw{command(bson.D{{Key: "_id", Value: "b"}, {Key: "name", Value: "b"}})},
+		}
+
+		events, err := m.newEvents(ctx, cmd, command(bson.D{{Key: "n", Value: 1}}))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, Delete, events[0].Action)
+		assert.Equal(t, "b", events[0].TableRowID)
+		assert.JSONEq(t, `{"_id":"b","name":"b"}`, events[0].OldValues)
+		assert.Equal(t, "{}", events[0].NewValues)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		cmd := &mongoCommand{
+			name:       "update",
+			collection: "users",
+			command:    command(bson.D{{Key: "update", Value: "users"}, {Key: "updates", Value: bson.A{bson.D{{Key: "q", Value: bson.D{{Key: "ssn", Value: "123-45-6789"}}}}}}}),
+			truncated:  true,
+		}
+
+		events, err := m.newEvents(ctx, cmd, command(bson.D{{Key: "n", Value: 5000}}))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, Update, events[0].Action)
+		assert.JSONEq(t, `{"collection":"users","operation":"update","rows_affected":5000}`, events[0].NewValues)
+	})
+
+	t.Run("without client", func(t *testing.T) {
+		cmd := &mongoCommand{
+			name:       "delete",
+			collection: "users",
+			command:    command(bson.D{{Key: "delete", Value: "users"}}),
+		}
+
+		require.NoError(t, (&MongoMonitor{}).readBefore(ctx, cmd))
+		assert.True(t, cmd.truncated)
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	expired := filepath.Join(dir, "audit-20000101-000000.000.jsonl.gz")
+	require.NoError(t, os.WriteFile(expired, nil, 0o600))
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(expired, old, old))
+	unrelated := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(unrelated, nil, 0o600))
+	require.NoError(t, os.Chtimes(unrelated, old, old))
+
+	sink, err := NewFileSink(FileConfig{
+		Dir:         dir,
+		MaxSize:     300,
+		RotateEvery: time.Hour,
+		Compress:    true,
+		Retention:   24 * time.Hour,
+		Sync:        SyncWrite,
+	})
+	require.NoError(t, err)
+
+	clock := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return clock }
+
+	event := Event{TableRowID: "1", Table: "users", Action: Insert, OldValues: "{}", NewValues: `{"email":"a@example.com"}`}
+	ctx := context.Background()
+
+	// the first write fills up the file, and the second rotates it by size
+	require.NoError(t, sink.Write(ctx, []Event{event, event}))
+	clock = clock.Add(time.Second)
+	require.NoError(t, sink.Write(ctx, []Event{event}))
+	// an hour later, the next write rotates it by time
+	clock = clock.Add(time.Hour)
+	require.NoError(t, sink.Write(ctx, []Event{event}))
+	require.NoError(t, sink.Close())
+	assert.Equal(t, ErrSinkClosed, sink.Write(ctx, []Event{event}))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	// the first file is named when the sink is created, before the clock is set
+	require.Len(t, names, 4)
+	assert.Equal(t, "audit-20210901-100001.000.jsonl.gz", names[0])
+	assert.Equal(t, "audit-20210901-110001.000.jsonl", names[1])
+	assert.Regexp(t, `^audit-\d{8}-\d{6}\.\d{3}\.jsonl\.gz$`, names[2])
+	assert.Equal(t, "notes.txt", names[3])
+
+	f, err := os.Open(filepath.Join(dir, names[2]))
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	var lines []string
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"actor_id":0,"table_row_id":"1","table_name":"users","action":"insert","old_values":{},
+		"new_values":{"email":"a@example.com"},"http_method":"","url":"","ip_address":"","user_agent":"",
+		"created_at":"0001-01-01T00:00:00Z"}`, lines[0])
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("secret")
+	var failures, requests int32
+	var received [][]map[string]interface{}
+	var deliveries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if r.Header.Get("X-Audit-Signature") != Signature(secret, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.NotEmpty(t, r.Header.Get("X-Audit-Delivery"))
+		deliveries = append(deliveries, r.Header.Get("X-Audit-Delivery"))
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload []map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &payload))
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	spool := t.TempDir()
+	sink, err := NewWebhookSink(WebhookConfig{
+		URL:        server.URL,
+		Secret:     secret,
+		Filter:     func(ev Event) bool { return ev.Table != "sessions" },
+		BatchSize:  2,
+		MaxRetries: 2,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		SpoolDir:   spool,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	events := []Event{
+		{TableRowID: "1", Table: "users", Action: Insert, OldValues: "{}", NewValues: `{"email":"a@example.com"}`},
+		{TableRowID: "1", Table: "sessions", Action: Insert, OldValues: "{}", NewValues: "{}"},
+		{TableRowID: "2", Table: "users", Action: Insert, OldValues: "{}", NewValues: "{}"},
+		{TableRowID: "3", Table: "users", Action: Insert, OldValues: "{}", NewValues: "{}"},
+	}
+
+	t.Run("retries", func(t *testing.T) {
+		atomic.StoreInt32(&failures, 2)
+		require.NoError(t, sink.Write(ctx, events))
+		require.Len(t, received, 2)
+		assert.Len(t, received[0], 2)
+		assert.Len(t, received[1], 1)
+		assert.Equal(t, map[string]interface{}{"email": "a@example.com"}, received[0][0]["new_values"])
+		assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("spools", func(t *testing.T) {
+		received = nil
+		atomic.StoreInt32(&failures, 3)
+		require.NoError(t, sink.Write(ctx, events[:1]))
+		assert.Empty(t, received)
+
+		spooled, err := os.ReadDir(spool)
+		require.NoError(t, err)
+		assert.Len(t, spooled, 1)
+
+		require.NoError(t, sink.Replay(ctx))
+		require.Len(t, received, 1)
+		assert.Equal(t, "1", received[0][0]["table_row_id"])
+
+		spooled, err = os.ReadDir(spool)
+		require.NoError(t, err)
+		assert.Empty(t, spooled)
+	})
+
+	t.Run("written again", func(t *testing.T) {
+		deliveries = nil
+		require.NoError(t, sink.Write(ctx, events[:1]))
+		require.NoError(t, sink.Write(ctx, events[:1]))
+		require.Len(t, deliveries, 2)
+		assert.Equal(t, deliveries[0], deliveries[1])
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		unsigned, err := NewWebhookSink(WebhookConfig{URL: server.URL, MinBackoff: time.Millisecond})
+		require.NoError(t, err)
+		before := atomic.LoadInt32(&requests)
+
+		err = unsigned.Write(ctx, events[:1])
+		assert.Error(t, err)
+		assert.Equal(t, before+1, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("dead letters", func(t *testing.T) {
+		dir := t.TempDir()
+		unsigned, err := NewWebhookSink(WebhookConfig{URL: server.URL, MinBackoff: time.Millisecond, SpoolDir: dir})
+		require.NoError(t, err)
+		before := atomic.LoadInt32(&requests)
+
+		require.NoError(t, unsigned.Write(ctx, events[:1]))
+		assert.Equal(t, before+1, atomic.LoadInt32(&requests))
+		_, err = unsigned.spool("rejected", []byte(`[]`), spoolExt)
+		require.NoError(t, err)
+		require.NoError(t, unsigned.Replay(ctx))
+
+		spooled, err := filepath.Glob(filepath.Join(dir, "*"))
+		require.NoError(t, err)
+		require.Len(t, spooled, 2)
+		for _, name := range spooled {
+			assert.True(t, strings.HasSuffix(name, deadLetterExt), name)
+		}
+	})
+
+	t.Run("replays past failures", func(t *testing.T) {
+		received = nil
+		body, err := json.Marshal([]jsonEvent{jsonEventOf(events[0])})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(spool, "1-first.json"), body, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(spool, "2-second.json"), body, 0o600))
+
+		atomic.StoreInt32(&failures, 3)
+		assert.Error(t, sink.Replay(ctx))
+		assert.Len(t, received, 1)
+		assert.FileExists(t, filepath.Join(spool, "1-first.json"))
+		assert.NoFileExists(t, filepath.Join(spool, "2-second.json"))
+	})
+}
@@ -0,0 +1,299 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrVerifyNotSupported    = fmt.Errorf("audit records can only be verified in the audit table")
+	ErrHashChainNotSupported = fmt.Errorf("the hash chain can only be kept in the audit table")
+)
+
+// ChainError is the first record at which the hash chain of the audit table is
+// broken, as found by Auditor.Verify.
+type ChainError struct {
+	ID     int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit record %d: %s", e.ID, e.Reason)
+}
+
+// chainSink links every event to the one saved before it by hash, one batch
+// at a time
+type chainSink struct {
+	sink Sink
+}
+
+func newChainSink(sink Sink) *chainSink {
+	return &chainSink{sink: sink}
+}
+
+func (c *chainSink) Write(ctx context.Context, events []Event) error {
+	sink, ok := c.sink.(*sqlSink)
+	if !ok {
+		return ErrHashChainNotSupported
+	}
+	return sink.writeChained(ctx, events)
+}
+
+// chain links the events to each other, the first one to the hash of prev.
+func chain(prev string, events []Event) []Event {
+	chained := make([]Event, len(events))
+	for i, ev := range events {
+		ev.PrevHash = prev
+		ev.Hash = eventHash(prev, ev)
+		prev = ev.Hash
+		chained[i] = ev
+	}
+	return chained
+}
+
+func (c *chainSink) Close() error {
+	if sink, ok := c.sink.(interface{ Close() error }); ok {
+		return sink.Close()
+	}
+	return nil
+}
+
+// eventHash is the SHA-256 of an event along with the hash of the one before
+// it.
+func eventHash(prevHash string, ev Event) string {
+	canonical, _ := json.Marshal(append([]interface{}{prevHash}, eventContent(ev)...))
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// eventContent is what of an event is hashed and signed, in the order of the
+// audit table
+func eventContent(ev Event) []interface{} {
+	return []interface{}{
+		ev.ActorID,
+		ev.TableRowID,
+		ev.Table,
+		ev.Action,
+		ev.OldValues,
+		ev.NewValues,
+		ev.HTTPMethod,
+		ev.URL,
+		ev.IPAddress,
+		ev.UserAgent,
+		// kept to the second, which every audit table stores
+		ev.CreatedAt.UTC().Truncate(time.Second).Format(time.RFC3339Nano),
+	}
+}
+
+// Verify checks the hash chain of the audit table from record from to to, 0 for
+// the last, and returns a *ChainError for the first broken record
+func (a *Auditor) Verify(ctx context.Context, from, to int64) error {
+	chain, ok := a.store.sink.(*chainSink)
+	if !ok {
+		return ErrVerifyNotSupported
+	}
+	sink, ok := chain.sink.(*sqlSink)
+	if !ok {
+		return ErrVerifyNotSupported
+	}
+
+	return sink.verify(ctx, from, to)
+}
+
+// writeChained inserts the events chained on from the latest record. The
+// record is read in the transaction the events are inserted in, with the table
+// locked against other writers, so that auditors sharing it keep to one chain.
+func (s *sqlSink) writeChained(ctx context.Context, events []Event) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// a locking read of the latest record does not keep others from adding one
+	// after it, so writers take turns by a lock of the table's name
+	if s.dbType == MysqlDB {
+		lock := "audit:" + s.table
+		if _, err := conn.ExecContext(ctx, "DO GET_LOCK(?, -1)", lock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", lock)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	switch s.dbType {
+	case PostgresDB:
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN SHARE ROW EXCLUSIVE MODE", s.table))
+	case SqliteDB:
+		// a write that changes nothing takes the database's write lock
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET hash = hash WHERE 0 = 1", s.table))
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var last sql.NullString
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT hash FROM %s ORDER BY id DESC LIMIT 1", s.table)).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, batch := range batches(chain(last.String, events), maxInsertRows) {
+		stmt, err := s.prepared(ctx, len(batch))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, s.batchArgs(batch)...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSink) verify(ctx context.Context, from, to int64) error {
+	// the first record is chained to the one before it, if any
+	var last sql.NullString
+	err := s.db.QueryRowContext(ctx, s.placeholders(fmt.Sprintf("SELECT hash FROM %s WHERE id < ? ORDER BY id DESC LIMIT 1", s.table)), from).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	prev := last.String
+
+	return s.records(ctx, from, to, func(id int64, ev Event) error {
+		if ev.Hash == "" {
+			return &ChainError{ID: id, Reason: "record is not hashed"}
+		}
+		if ev.PrevHash != prev {
+			return &ChainError{ID: id, Reason: "record does not follow the one before it"}
+		}
+		if eventHash(ev.PrevHash, ev) != ev.Hash {
+			return &ChainError{ID: id, Reason: "record does not match its hash"}
+		}
+		prev = ev.Hash
+		return nil
+	})
+}
+
+// records reads the records of the audit table from id from to to, 0 for the
+// last
+func (s *sqlSink) records(ctx context.Context, from, to int64, fn func(id int64, ev Event) error) error {
+	columns := "id, actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at"
+	if s.hashed {
+		columns += ", prev_hash, hash"
+	}
+	if s.signed {
+		columns += ", key_id, signature"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id >= ? AND (? = 0 OR id <= ?) ORDER BY id", columns, s.table)
+	rows, err := s.db.QueryContext(ctx, s.placeholders(query), from, to, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var actorID sql.NullInt64
+		var tableRowID, table, action, oldValues, newValues, method, url, ip, userAgent sql.NullString
+		var prevHash, hash, keyID, signature sql.NullString
+		var createdAt scannedTime
+		dest := []interface{}{&id, &actorID, &tableRowID, &table, &action, &oldValues, &newValues, &method, &url, &ip, &userAgent, &createdAt}
+		if s.hashed {
+			dest = append(dest, &prevHash, &hash)
+		}
+		if s.signed {
+			dest = append(dest, &keyID, &signature)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		ev := Event{
+			ActorID:    uint64(actorID.Int64),
+			TableRowID: tableRowID.String,
+			Table:      table.String,
+			Action:     Action(action.String),
+			OldValues:  oldValues.String,
+			NewValues:  newValues.String,
+			HTTPMethod: method.String,
+			URL:        url.String,
+			IPAddress:  ip.String,
+			UserAgent:  userAgent.String,
+			CreatedAt:  createdAt.Time,
+			PrevHash:   prevHash.String,
+			Hash:       hash.String,
+			KeyID:      keyID.String,
+			Signature:  signature.String,
+		}
+		if err := fn(id, ev); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// scannedTime reads a time column, which MySQL gives as text unless the
+// connection is opened with `parseTime=true`.
+type scannedTime struct {
+	Time time.Time
+}
+
+func (t *scannedTime) Scan(src interface{}) error {
+	var text string
+	switch src := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = src
+		return nil
+	case []byte:
+		text = string(src)
+	case string:
+		text = src
+	default:
+		return fmt.Errorf("created_at of type %T cannot be read as a time", src)
+	}
+
+	// times are saved in UTC, and read back as such without a zone
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00"} {
+		parsed, err := time.ParseInLocation(layout, text, time.UTC)
+		if err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("created_at %q cannot be read as a time", text)
+}
+
+// placeholders numbers the placeholders of a query for Postgres.
+func (s *sqlSink) placeholders(query string) string {
+	if s.dbType != PostgresDB {
+		return query
+	}
+
+	var b []byte
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			b = append(b, query[i])
+			continue
+		}
+		n++
+		b = append(b, fmt.Sprintf("$%d", n)...)
+	}
+	return string(b)
+}
@@ -5,98 +5,285 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
-	MysqlCreate    = "CREATE TABLE IF NOT EXISTS %s (id bigint unsigned auto_increment primary key, actor_id bigint unsigned null, table_row_id bigint unsigned null,table_name varchar(255) null,action varchar(10) null,old_values longtext collate utf8mb4_bin null,new_values longtext collate utf8mb4_bin null,http_method varchar(11) null,url text null,ip_address text null,user_agent text null,created_at datetime null,constraint new_values    check (json_valid(new_values)),constraint old_values    check (json_valid(old_values)));"
+	MysqlCreate    = "CREATE TABLE IF NOT EXISTS %s (id bigint unsigned auto_increment primary key, actor_id bigint unsigned null, table_row_id varchar(255) null,table_name varchar(255) null,action varchar(10) null,old_values longtext collate utf8mb4_bin null,new_values longtext collate utf8mb4_bin null,http_method varchar(11) null,url text null,ip_address text null,user_agent text null,created_at datetime null,prev_hash char(64) null,hash char(64) null,key_id varchar(255) null,signature char(64) null,constraint new_values    check (json_valid(new_values)),constraint old_values    check (json_valid(old_values)));"
 	MysqlInsert    = "INSERT INTO %s (actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?)"
-	MysqlSelect    = "SELECT * FROM %s WHERE %v %s ?"
-	PostgresCreate = "CREATE TABLE IF NOT EXISTS %s (id bigserial constraint audits_pk primary key, actor_id bigserial, table_row_id bigserial, table_name text, action varchar(11), old_values json, new_values json, http_method varchar(11), url text, ip_address text, user_agent text, created_at timestamp with time zone);"
+	PostgresCreate = "CREATE TABLE IF NOT EXISTS %s (id bigserial constraint audits_pk primary key, actor_id bigserial, table_row_id text, table_name text, action varchar(11), old_values json, new_values json, http_method varchar(11), url text, ip_address text, user_agent text, created_at timestamp with time zone, prev_hash text, hash text, key_id text, signature text);"
 	PostgresInsert = "INSERT INTO %s (actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)"
-	PostgresSelect = "SELECT * FROM %s WHERE %v %s $1" // todo: support IN operator
+	SqliteCreate   = "CREATE TABLE IF NOT EXISTS %s (id integer primary key autoincrement, actor_id integer null, table_row_id text null, table_name text null, action varchar(10) null, old_values text null, new_values text null, http_method varchar(11) null, url text null, ip_address text null, user_agent text null, created_at datetime null, prev_hash text null, hash text null, key_id text null, signature text null);"
+	SqliteInsert   = "INSERT INTO %s (actor_id, table_row_id, table_name, action, old_values, new_values, http_method, url, ip_address, user_agent, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?)"
 )
 
 type Auditor struct {
 	auditTableName string
 	tableException []string
+	// policies say what is audited of the tables they match.
+	policies []Policy
+	// err is the first option that could not be set, given by NewAudit.
+	err error
 
 	store
 }
 
 type query struct {
-	insert     string
-	create     string
-	selectStmt string
+	table  string
+	insert string
+	create string
 }
 
 type store struct {
 	dbType string
 	sql    *sql.DB
-	mongo  *mongo.Client
+
+	// mongo saves events into mongoDatabase, when set.
+	mongo         *mongo.Client
+	mongoDatabase string
 
 	query
 	parser   *Parser
 	internal *sql.DB
+	sink     Sink
+
+	// auditDB, when set, is the database the audit table is kept in
+	auditDB     *sql.DB
+	auditDBType string
+	ownAuditDB  bool
+
+	// hashChain links every event saved to the one before it by hash.
+	hashChain bool
+	// signingKeys signs every event, when set.
+	signingKeys KeyProvider
+	// redaction hides the values of sensitive columns.
+	redaction []RedactRule
+	// encrypter encrypts the values of the events of encryptedTables, or of
+	// every table when there are none.
+	encrypter       KeyEncrypter
+	encryptedTables []string
+
+	// queue writes events to the sink in the background, when set up by
+	// queueConfig.
+	queue       *queue
+	queueConfig *QueueConfig
+
+	rowLimit  int
+	postImage bool
+
+	// sameTransaction writes the audit rows of a transaction in it, instead of
+	// after it commits.
+	sameTransaction bool
+
+	// onError is given the events that could not be saved after their
+	// transaction committed.
+	onError func(err error, events []Event)
+
+	// consistentPreImage reads old values on the connection of the statement,
+	// locking the rows until it is done.
+	consistentPreImage bool
+
+	// defaultSchema is the schema of tables named without one.
+	defaultSchema string
+
+	// primaryKeys holds the primary key columns set for each table, while
+	// discoveredKeys caches those read from the database catalog.
+	primaryKeys    map[string][]string
+	discoveredKeys *keyCache
 }
 
 var (
 	ErrInvalidQuery       = fmt.Errorf("invalid query")
 	ErrDriverNotSupported = fmt.Errorf("driver is not supported")
+	ErrSameTransaction    = fmt.Errorf("audit rows cannot be written in the transaction with a hash chain, a queue or an audit database")
 )
 
 const (
 	MysqlDB    string = "mysql"
 	PostgresDB string = "postgres"
+	SqliteDB   string = "sqlite3"
 	MongoDB    string = "mongo"
 )
 
-func (a *store) newPostgresAuditor(internal *sql.DB, db *sql.DB) error {
-	_, err := db.ExecContext(context.Background(), a.query.create)
+// newSink sets up the audit table or collection events are saved into, unless a
+// sink is set
+func (a *store) newSink() error {
+	if a.sink != nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	if a.mongo != nil {
+		collection := a.mongo.Database(a.mongoDatabase).Collection(a.query.table)
+		sink, err := newMongoSink(ctx, collection)
+		if err != nil {
+			return err
+		}
+		a.sink = sink
+		return nil
+	}
+
+	db, dbType, q := a.internal, a.dbType, a.query
+	if a.auditDB != nil {
+		var err error
+		db, dbType = a.auditDB, a.auditDBType
+		q, err = auditQuery(dbType, a.query.table)
+		if err != nil {
+			return err
+		}
+	}
+	if db == nil {
+		return nil
+	}
+
+	if _, err := db.ExecContext(ctx, q.create); err != nil {
+		// a user that may only insert into the audit table cannot create it,
+		// which is fine once it exists
+		stmt, e := db.PrepareContext(ctx, q.insert)
+		if e != nil {
+			return err
+		}
+		_ = stmt.Close()
+	}
+	if err := migrateAuditTable(ctx, db, dbType, q.table, a.hashChain, a.signingKeys != nil); err != nil {
+		return err
+	}
+	sink := newSqlSink(db, dbType, q.table, q.insert)
+	sink.hashed = a.hashChain
+	sink.signed = a.signingKeys != nil
+	a.sink = sink
+
+	return nil
+}
+
+// auditQuery gives the statements the audit table is created and written with
+// in a dialect.
+func auditQuery(dbType, table string) (query, error) {
+	q := query{table: table}
+	switch dbType {
+	case MysqlDB:
+		q.insert = fmt.Sprintf(MysqlInsert, table)
+		q.create = fmt.Sprintf(MysqlCreate, table)
+	case PostgresDB:
+		q.insert = fmt.Sprintf(PostgresInsert, table)
+		q.create = fmt.Sprintf(PostgresCreate, table)
+	case SqliteDB:
+		q.insert = fmt.Sprintf(SqliteInsert, table)
+		q.create = fmt.Sprintf(SqliteCreate, table)
+	default:
+		return query{}, ErrDriverNotSupported
+	}
+	return q, nil
+}
+
+// addedColumns are the audit table columns added after it was first released,
+// with their type in each dialect.
+var addedColumns = []struct {
+	name  string
+	types map[string]string
+}{
+	{"prev_hash", map[string]string{MysqlDB: "char(64) null", PostgresDB: "text", SqliteDB: "text null"}},
+	{"hash", map[string]string{MysqlDB: "char(64) null", PostgresDB: "text", SqliteDB: "text null"}},
+	{"key_id", map[string]string{MysqlDB: "varchar(255) null", PostgresDB: "text", SqliteDB: "text null"}},
+	{"signature", map[string]string{MysqlDB: "char(64) null", PostgresDB: "text", SqliteDB: "text null"}},
+}
+
+// migrateAuditTable adds the columns missing from an audit table created by an
+// earlier version, and makes table_row_id text
+func migrateAuditTable(ctx context.Context, db *sql.DB, dbType, table string, hashed, signed bool) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", table))
 	if err != nil {
 		return err
 	}
+	columnTypes, err := rows.ColumnTypes()
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]string, len(columnTypes))
+	for _, column := range columnTypes {
+		existing[strings.ToLower(column.Name())] = strings.ToUpper(column.DatabaseTypeName())
+	}
+
+	for _, column := range addedColumns {
+		if _, ok := existing[column.name]; ok {
+			continue
+		}
+		_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column.name, column.types[dbType]))
+		if err == nil {
+			continue
+		}
+		needed := (hashed && (column.name == "prev_hash" || column.name == "hash")) ||
+			(signed && (column.name == "key_id" || column.name == "signature"))
+		if needed {
+			return fmt.Errorf("audit table %s is missing column %s: %w", table, column.name, err)
+		}
+		log.Printf("audit: column %s not added to %s: %v", column.name, table, err)
+	}
+
+	// SQLite stores text in an integer column as it is
+	if !strings.Contains(existing["table_row_id"], "INT") || dbType == SqliteDB {
+		return nil
+	}
+	var alter string
+	switch dbType {
+	case MysqlDB:
+		alter = fmt.Sprintf("ALTER TABLE %s MODIFY table_row_id varchar(255) null", table)
+	case PostgresDB:
+		alter = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN table_row_id DROP DEFAULT, ALTER COLUMN table_row_id TYPE text", table)
+	}
+	if _, err := db.ExecContext(ctx, alter); err != nil {
+		log.Printf("audit: table_row_id of %s not changed to text: %v", table, err)
+	}
+	return nil
+}
+
+func (a *store) newPostgresAuditor(internal *sql.DB, db *sql.DB) error {
 	a.dbType = PostgresDB
 
 	a.parser = NewParser(a.dbType)
 	postgres := &PostgresParser{
 		internal: internal,
 		db:       db,
-		query:    a.query,
 	}
 	a.parser.PostgresParser = postgres
 
-	return err
+	return nil
 }
 
 func (a *store) newMysqlAuditor(internal *sql.DB, db *sql.DB) error {
-	_, err := internal.ExecContext(context.Background(), a.query.create)
-	if err != nil {
-		return err
-	}
 	a.dbType = MysqlDB
 
 	a.parser = NewParser(a.dbType)
 	mysql := &MysqlParser{
 		internal: internal,
 		db:       db,
-		query:    a.query,
 	}
 
 	a.parser.MysqlParser = mysql
 
-	return err
+	return nil
 }
 
-//func (a *store) newMongoAuditor(kv *mongo.Client) error {
-//	a.dbType = MongoDB
-//	a.mongo = kv
-//
-//	return nil
-//}
+func (a *store) newSqliteAuditor(internal *sql.DB, db *sql.DB) error {
+	a.dbType = SqliteDB
+
+	a.parser = NewParser(a.dbType)
+	sqlite := &SqliteParser{
+		MysqlParser: &MysqlParser{
+			internal: internal,
+			db:       db,
+		},
+	}
+	a.parser.SqliteParser = sqlite
+
+	return nil
+}
 
 type DBOption func(*Auditor)
 
@@ -109,12 +296,123 @@ func (a *Auditor) SetDB(opts ...DBOption) error {
 	case MysqlDB:
 		fallthrough
 	case PostgresDB:
-		return nil
+		fallthrough
+	case SqliteDB:
+		if a.store.sameTransaction && (a.store.hashChain || a.store.queueConfig != nil || a.store.auditDB != nil) {
+			return ErrSameTransaction
+		}
+		if err := a.store.newSink(); err != nil {
+			return err
+		}
+		if err := a.store.chainSink(); err != nil {
+			return err
+		}
+		return a.store.startQueue()
 	default:
 		return ErrDriverNotSupported
 	}
 }
 
+// reportError gives the events that could not be saved to the error handler,
+// or logs them without one.
+func (a *store) reportError(err error, events []Event) {
+	if a.onError != nil {
+		a.onError(err, events)
+		return
+	}
+	log.Printf("audit: %d events: %v", len(events), err)
+}
+
+// chainSink wraps the sink in a hash chain, when set up by WithHashChain. The
+// chain goes on from the latest record, which only the audit table gives.
+func (a *store) chainSink() error {
+	if _, ok := a.sink.(*chainSink); !a.hashChain || a.sink == nil || ok {
+		return nil
+	}
+	if _, ok := a.sink.(*sqlSink); !ok {
+		return ErrHashChainNotSupported
+	}
+	a.sink = newChainSink(a.sink)
+	return nil
+}
+
+// startQueue starts the queue once there is a sink to write to, if one is set
+// up.
+func (a *store) startQueue() error {
+	if a.queueConfig == nil || a.queue != nil || a.sink == nil {
+		return nil
+	}
+	q, err := newQueue(a.sink, *a.queueConfig)
+	if err != nil {
+		return err
+	}
+	a.queue = q
+	return nil
+}
+
+// Close waits for the queued events to be saved, then releases the connections
+// of the auditor. Events given to the auditor afterwards are not saved.
+func (a *Auditor) Close(ctx context.Context) error {
+	if a.store.queue != nil {
+		if err := a.store.queue.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if sink, ok := a.store.sink.(interface{ Close() error }); ok {
+		if err := sink.Close(); err != nil {
+			return err
+		}
+	}
+	if a.store.mongo != nil {
+		if err := a.store.mongo.Disconnect(ctx); err != nil {
+			return err
+		}
+	}
+	if a.store.ownAuditDB {
+		if err := a.store.auditDB.Close(); err != nil {
+			return err
+		}
+	}
+	if a.store.internal != nil {
+		return a.store.internal.Close()
+	}
+	return nil
+}
+
+// Dropped is the number of events left out by a full queue with QueueDrop.
+func (a *Auditor) Dropped() uint64 {
+	if a.store.queue == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.store.queue.dropped)
+}
+
+// getAction is the action of a statement, as read from its query alone.
+func (a *Auditor) getAction(query string) (Action, error) {
+	switch a.store.dbType {
+	case MysqlDB:
+		stmt, err := parseMysql(query)
+		if err != nil {
+			return "", err
+		}
+		return Action(getSqlAction(stmt)), nil
+	case PostgresDB:
+		stmt, err := parsePostgres(query)
+		if err != nil {
+			return "", err
+		}
+		return Action(getPostgresAction(stmt)), nil
+	case SqliteDB:
+		stmt, err := parseMysql(sqliteQuery(query))
+		if err != nil {
+			return "", sqliteSyntax(query, err)
+		}
+		return Action(getSqlAction(stmt)), nil
+	default:
+		return "", ErrDriverNotSupported
+	}
+}
+
 func (a *Auditor) GetTableName(query string) (tableName string, err error) {
 	if a.store.parser == nil {
 		return "", nil
@@ -124,6 +422,8 @@ func (a *Auditor) GetTableName(query string) (tableName string, err error) {
 		return a.parser.MysqlParser.getTableName(query)
 	case "postgres":
 		return a.parser.PostgresParser.getTableName(query)
+	case "sqlite3":
+		return a.parser.SqliteParser.getTableName(query)
 	default:
 		return "", ErrDriverNotSupported
 	}
@@ -138,12 +438,13 @@ func Postgres(db *sql.DB, dsn string) DBOption {
 		a.store.internal = internal
 
 		q := query{
-			insert:     fmt.Sprintf(PostgresInsert, a.auditTableName),
-			create:     fmt.Sprintf(PostgresCreate, a.auditTableName),
-			selectStmt: PostgresSelect,
+			table:  a.auditTableName,
+			insert: fmt.Sprintf(PostgresInsert, a.auditTableName),
+			create: fmt.Sprintf(PostgresCreate, a.auditTableName),
 		}
 		a.store.query = q
 		a.store.sql = db
+		a.store.defaultSchema = "public"
 		err = a.newPostgresAuditor(a.store.internal, a.store.sql)
 		if err != nil {
 			log.Fatal(err)
@@ -160,15 +461,64 @@ func MySql(db *sql.DB, dsn string) DBOption {
 		a.store.internal = internal
 
 		q := query{
-			insert:     fmt.Sprintf(MysqlInsert, a.auditTableName),
-			create:     fmt.Sprintf(MysqlCreate, a.auditTableName),
-			selectStmt: MysqlSelect,
+			table:  a.auditTableName,
+			insert: fmt.Sprintf(MysqlInsert, a.auditTableName),
+			create: fmt.Sprintf(MysqlCreate, a.auditTableName),
 		}
 		a.store.query = q
 		a.store.sql = db
+		if config, err := mysql.ParseDSN(dsn); err == nil {
+			a.store.defaultSchema = config.DBName
+		}
 		err = a.newMysqlAuditor(a.store.internal, a.store.sql)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 }
+
+// Sqlite sets the SQLite database, whose DSN the audit table is written through
+func Sqlite(db *sql.DB, dsn string) DBOption {
+	return func(a *Auditor) {
+		internal, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.store.internal = internal
+
+		q := query{
+			table:  a.auditTableName,
+			insert: fmt.Sprintf(SqliteInsert, a.auditTableName),
+			create: fmt.Sprintf(SqliteCreate, a.auditTableName),
+		}
+		a.store.query = q
+		a.store.sql = db
+		a.store.defaultSchema = "main"
+		err = a.newSqliteAuditor(a.store.internal, a.store.sql)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// AuditDB keeps the audit table in another database, of any supported type
+func AuditDB(db *sql.DB, dbType string) DBOption {
+	return func(a *Auditor) {
+		a.store.auditDB = db
+		a.store.auditDBType = dbType
+		a.store.query.table = a.auditTableName
+	}
+}
+
+// AuditDSN opens the database events are saved into, as with AuditDB. It is
+// closed along with the auditor.
+func AuditDSN(dbType, dsn string) DBOption {
+	return func(a *Auditor) {
+		db, err := sql.Open(dbType, dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		AuditDB(db, dbType)(a)
+		a.store.ownAuditDB = true
+	}
+}
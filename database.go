@@ -2,9 +2,13 @@ package audit
 
 import (
 	"context"
-	"regexp"
-	"strconv"
-	"strings"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
 )
 
 func (a *Auditor) SetEvent(ctx context.Context, event Event, tableName, query string, args []interface{}) (Event, error) {
@@ -13,85 +17,465 @@ func (a *Auditor) SetEvent(ctx context.Context, event Event, tableName, query st
 		return a.store.parser.MysqlParser.setEvent(ctx, a.store, a.auditTableName, event, tableName, query, args)
 	case PostgresDB:
 		return a.store.parser.PostgresParser.setEvent(ctx, a.store, a.auditTableName, event, tableName, query, args)
+	case SqliteDB:
+		return a.store.parser.SqliteParser.setEvent(ctx, a.store, a.auditTableName, event, tableName, query, args)
 	default:
 		return Event{}, ErrDriverNotSupported
 	}
 }
 
+// WhereClause holds the SELECT that reads the rows matched by a statement's
+// WHERE clause, along with the values bound to its placeholders.
 type WhereClause struct {
-	id        uint64
+	tableName  string
+	primaryKey []string
+	query      string
+	vals       []interface{}
+	rows       []row
+
+	// truncated is set when the statement matches more rows than the row
+	// limit, in which case a single summary event is saved.
+	truncated    bool
+	rowsAffected int64
+
+	// upsert is how an INSERT resolves a collision with an existing row, and
+	// conflicts holds the existing row, if any, for each inserted row.
+	upsert    upsert
+	conflicts []*row
+
+	// joined holds the other tables written to by an UPDATE or DELETE over
+	// several tables, each with its own rows.
+	joined []WhereClause
+
+	// postImage holds the rows as they read after the statement.
+	postImage map[rowRef]string
+}
+
+// targets gives every table written to by the statement along with its rows.
+func (w WhereClause) targets() []WhereClause {
+	return append([]WhereClause{w}, w.joined...)
+}
+
+// rowRef identifies a row across tables.
+type rowRef struct {
 	tableName string
-	col       string
-	operator  string
-	val       interface{}
+	id        string
+}
+
+// upsert is the way an INSERT handles rows that already exist.
+type upsert int
+
+const (
+	upsertNone    upsert = iota
+	upsertNothing        // ON CONFLICT DO NOTHING, INSERT IGNORE
+	upsertUpdate         // ON CONFLICT DO UPDATE, ON DUPLICATE KEY UPDATE
+	upsertReplace        // REPLACE INTO
+)
+
+// row is a row read from a table, with its id and primary key values
+type row struct {
+	id        string
+	key       map[string]string
+	oldValues string
+}
+
+// defaultPrimaryKey is the primary key assumed for tables without one.
+var defaultPrimaryKey = []string{"id"}
+
+// rowID formats the primary key of a row. A single column key is its value,
+// while a composite key is a JSON object of its columns.
+func rowID(key map[string]string, primaryKey []string) (string, bool) {
+	for _, col := range primaryKey {
+		if _, ok := key[col]; !ok {
+			return "", false
+		}
+	}
+	if len(primaryKey) == 1 {
+		return key[primaryKey[0]], true
+	}
+
+	columns := make(map[string]string, len(primaryKey))
+	for _, col := range primaryKey {
+		columns[col] = key[col]
+	}
+	marshalled, err := json.Marshal(columns)
+	if err != nil {
+		return "", false
+	}
+	return string(marshalled), true
+}
+
+// keyValues is the reverse of rowID, giving the value of each primary key
+// column from the row id.
+func keyValues(id string, primaryKey []string) (map[string]string, error) {
+	if len(primaryKey) == 1 {
+		return map[string]string{primaryKey[0]: id}, nil
+	}
+
+	var key map[string]string
+	if err := json.Unmarshal([]byte(id), &key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-func (a *Auditor) Save(ctx context.Context, query string, args []interface{}, lastInsertID int64, event Event) error {
+// setPrimaryKey gives the primary key set with WithPrimaryKey for a table,
+// matched the way table exceptions are.
+func (s store) setPrimaryKey(tableName string) ([]string, bool) {
+	if tableName == "" {
+		return nil, false
+	}
+	for table, columns := range s.primaryKeys {
+		if isExempted([]string{table}, tableName, s.defaultSchema) {
+			return columns, true
+		}
+	}
+	return nil, false
+}
+
+// primaryKeyOf gives the primary key columns of a table, either as set with
+// WithPrimaryKey, or as read from the database catalog.
+func (s store) primaryKeyOf(ctx context.Context, tableName string) ([]string, error) {
+	columns, err := s.knownPrimaryKeyOf(ctx, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return defaultPrimaryKey, nil
+	}
+
+	return columns, nil
+}
+
+// knownPrimaryKeyOf is primaryKeyOf without the default, giving no columns for
+// a table whose primary key is neither set nor found.
+func (s store) knownPrimaryKeyOf(ctx context.Context, tableName string) ([]string, error) {
+	if columns, ok := s.setPrimaryKey(tableName); ok {
+		return columns, nil
+	}
+	if s.parser == nil || s.discoveredKeys == nil {
+		return nil, nil
+	}
+	if keys, ok := s.discoveredKeys.get(tableName); ok {
+		return keys[0], nil
+	}
+
+	var columns []string
 	var err error
-	switch a.dbType {
+	switch s.dbType {
 	case MysqlDB:
-		err = a.parser.MysqlParser.Save(ctx, query, args, lastInsertID, event)
+		columns, err = s.parser.MysqlParser.getPrimaryKey(ctx, s, tableName)
 	case PostgresDB:
-		err = a.parser.PostgresParser.Save(ctx, query, args, lastInsertID, event)
+		columns, err = s.parser.PostgresParser.getPrimaryKey(ctx, s, tableName)
+	case SqliteDB:
+		columns, err = s.parser.SqliteParser.getPrimaryKey(ctx, s, tableName)
 	default:
-		return ErrDriverNotSupported
+		return nil, ErrDriverNotSupported
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return err
+	s.discoveredKeys.set(tableName, [][]string{columns})
+
+	return columns, nil
 }
 
-func getColumnNamesFromInsert(query string) []string {
-	r := regexp.MustCompile("into(.*)values")
-	return getColumnNames(r, query)
+// keyCache keeps the primary or unique keys of each table, as read from the
+// database catalog, so that they are only looked up once.
+type keyCache struct {
+	mu   sync.RWMutex
+	keys map[string][][]string
 }
 
-func getColumnNamesFromUpdate(query string) []string {
-	r := regexp.MustCompile("set(.*)where")
+func (c *keyCache) get(tableName string) ([][]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	idx := r.FindStringIndex(strings.ToLower(query))
-	part := query[idx[0]:idx[1]]
+	keys, ok := c.keys[tableName]
+	return keys, ok
+}
 
-	parts := strings.Split(part, " ")
-	cols := strings.Split(parts[1], ",")
+func (c *keyCache) set(tableName string, keys [][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	var ret []string
-	for _, col := range cols {
-		splits := strings.Split(col, "=")
-		ret = append(ret, splits[0])
+	if c.keys == nil {
+		c.keys = make(map[string][][]string)
 	}
-	return ret
+	c.keys[tableName] = keys
 }
 
-func getColumnNames(r *regexp.Regexp, query string) []string {
-	idx := r.FindStringIndex(strings.ToLower(query))
-	part := query[idx[0]:idx[1]]
+// insertEvents builds an event for every row of an INSERT, taking the ids in
+// order, and turns the rows of an upsert that already existed into updates
+func insertEvents(event Event, inserted, updated []map[string]interface{}, insertIDs []string, updateReturnsID bool) ([]Event, error) {
+	primaryKey := event.WhereClause.primaryKey
+	if len(primaryKey) == 0 {
+		primaryKey = defaultPrimaryKey
+	}
+
+	next := 0
+	nextID := func(values map[string]interface{}) (string, bool) {
+		if next >= len(insertIDs) {
+			return "", false
+		}
+		next++
+		id := insertIDs[next-1]
+		if len(primaryKey) == 1 {
+			values[primaryKey[0]] = id
+		}
+		return id, true
+	}
 
-	splits := strings.Split(part, " ")
-	getCols := splits[2 : len(splits)-1]
-	cols := strings.Join(getCols, " ")
+	events := make([]Event, 0, len(inserted))
+	for i, values := range inserted {
+		var conflict *row
+		if i < len(event.WhereClause.conflicts) {
+			conflict = event.WhereClause.conflicts[i]
+		}
 
-	cols = strings.ReplaceAll(cols, "(", "")
-	cols = strings.ReplaceAll(cols, ")", "")
-	cols = strings.ReplaceAll(cols, "`", "")
-	splits = strings.Split(cols, ",")
+		ev := event
+		ev.CreatedAt = time.Now()
+		switch {
+		case conflict == nil:
+			if id, ok := nextID(values); ok {
+				ev.TableRowID = id
+			} else {
+				ev.TableRowID = insertedID(values, primaryKey)
+			}
+		case event.WhereClause.upsert == upsertNothing:
+			continue
+		case event.WhereClause.upsert == upsertUpdate:
+			if updateReturnsID {
+				nextID(make(map[string]interface{}))
+			}
+			ev.Action = Update
+			ev.TableRowID = conflict.id
+			ev.OldValues = conflict.oldValues
+			values = make(map[string]interface{})
+			if i < len(updated) {
+				for col, val := range updated[i] {
+					values[col] = val
+				}
+			}
+			for col, val := range conflict.key {
+				values[col] = val
+			}
+		case event.WhereClause.upsert == upsertReplace:
+			ev.Action = Update
+			ev.TableRowID = conflict.id
+			ev.OldValues = conflict.oldValues
+			if id, ok := nextID(values); ok {
+				ev.TableRowID = id
+			}
+		}
 
-	var names []string
-	for _, val := range splits {
-		names = append(names, strings.TrimSpace(val))
+		marshalled, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		ev.NewValues = string(marshalled)
+		events = append(events, ev)
 	}
 
-	return names
+	return events, nil
 }
 
-func getNameAndWherePositionForUpdate(s string) (name string, position int, err error) {
-	index := regexp.MustCompile("where(.*?)").FindStringIndex(s)
-	where := strings.TrimSpace(s[index[1]:]) //  id = :v3
-	splits := strings.Split(where, " ")
+// insertedID gives the id of an inserted row from the values of its primary key
+// columns, if they were all given.
+func insertedID(values map[string]interface{}, primaryKey []string) string {
+	key := make(map[string]string, len(primaryKey))
+	for _, col := range primaryKey {
+		val, ok := values[col]
+		if !ok {
+			return ""
+		}
+		key[col] = fmt.Sprint(val)
+	}
+
+	id, _ := rowID(key, primaryKey)
+	return id
+}
+
+// summaryValues describes a statement that affected too many rows to be audited
+// one by one.
+func summaryValues(query string, rowsAffected int64) string {
+	marshalled, err := json.Marshal(map[string]interface{}{
+		"query":         query,
+		"rows_affected": rowsAffected,
+	})
+	if err != nil {
+		return "{}"
+	}
+
+	return string(marshalled)
+}
+
+// scanRows reads every row into a JSON object of its columns. The primary key
+// columns are used as the row identifier.
+func scanRows(rows *sql.Rows, primaryKey []string) ([]row, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []row
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		for i := range cols {
+			vals[i] = new(sql.RawBytes)
+		}
+		if err = rows.Scan(vals...); err != nil {
+			return nil, err
+		}
+
+		toString := make(map[string]string, len(cols))
+		for i, val := range vals {
+			content := reflect.ValueOf(val).Interface().(*sql.RawBytes)
+			toString[cols[i]] = string(*content)
+		}
+
+		r, err := newRow(toString, primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+
+	return out, rows.Err()
+}
+
+// uniqueRows leaves out repeated rows, which are read when a table is joined to
+// several rows of another.
+func uniqueRows(rows []row) []row {
+	seen := make(map[string]bool, len(rows))
+	out := rows[:0]
+	for _, r := range rows {
+		if r.id != "" && seen[r.id] {
+			continue
+		}
+		seen[r.id] = true
+		out = append(out, r)
+	}
+	return out
+}
+
+// newRow keeps the values of a row along with its primary key.
+func newRow(values map[string]string, primaryKey []string) (row, error) {
+	r := row{key: make(map[string]string, len(primaryKey))}
+	for _, col := range primaryKey {
+		if val, ok := values[col]; ok {
+			r.key[col] = val
+		}
+	}
+	r.id, _ = rowID(r.key, primaryKey)
+
+	marshaled, err := json.Marshal(values)
+	if err != nil {
+		return row{}, err
+	}
+	r.oldValues = string(marshaled)
 
-	position, err = strconv.Atoi(splits[2][2:])
+	return r, nil
+}
+
+// readPostImage reads the rows as they are after an insert or update
+func (a *Auditor) readPostImage(ctx context.Context, query string, args []interface{}, result driver.Result, rows driver.Rows, insertIDs []string, event Event) (map[rowRef]string, error) {
+	postImage := make(map[rowRef]string)
+
+	written, err := returnedValues(result, rows, event.WhereClause.primaryKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(written) > 0 {
+		for _, r := range written {
+			postImage[rowRef{tableName: event.Table, id: r.id}] = r.oldValues
+		}
+		return postImage, nil
+	}
+
+	targets := event.WhereClause.targets()
+	ids := make([][]string, len(targets))
+	switch event.Action {
+	case Insert:
+		var events []Event
+		switch a.dbType {
+		case MysqlDB:
+			events, err = a.parser.MysqlParser.setNewInsertValues(ctx, event, insertIDs, query, args)
+		case PostgresDB:
+			events, err = a.parser.PostgresParser.setNewInsertValues(ctx, event, insertIDs, query, args)
+		case SqliteDB:
+			events, err = a.parser.SqliteParser.setNewInsertValues(ctx, event, insertIDs, query, args)
+		default:
+			return nil, ErrDriverNotSupported
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range events {
+			if ev.TableRowID != "" {
+				ids[0] = append(ids[0], ev.TableRowID)
+			}
+		}
+	case Update:
+		for i, w := range targets {
+			for _, r := range w.rows {
+				ids[i] = append(ids[i], r.id)
+			}
+		}
+	}
+
+	for i, w := range targets {
+		if len(ids[i]) == 0 {
+			continue
+		}
+
+		switch a.dbType {
+		case MysqlDB:
+			written, err = a.parser.MysqlParser.readRows(ctx, a.store, w.tableName, w.primaryKey, ids[i])
+		case PostgresDB:
+			written, err = a.parser.PostgresParser.readRows(ctx, a.store, w.tableName, w.primaryKey, ids[i])
+		case SqliteDB:
+			written, err = a.parser.SqliteParser.readRows(ctx, a.store, w.tableName, w.primaryKey, ids[i])
+		default:
+			return nil, ErrDriverNotSupported
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range written {
+			postImage[rowRef{tableName: w.tableName, id: r.id}] = r.oldValues
+		}
+	}
+
+	return postImage, nil
+}
+
+// withPostImage sets the new values of the event to its row as read after the
+// statement, if it was.
+func withPostImage(event Event) Event {
+	if values, ok := event.WhereClause.postImage[rowRef{tableName: event.Table, id: event.TableRowID}]; ok {
+		event.NewValues = values
+	}
+	return event
+}
+
+func (a *Auditor) Save(ctx context.Context, query string, args []interface{}, insertIDs []string, event Event) error {
+	var events []Event
+	var err error
+	switch a.dbType {
+	case MysqlDB:
+		events, err = a.parser.MysqlParser.newEvents(ctx, query, args, insertIDs, event)
+	case PostgresDB:
+		events, err = a.parser.PostgresParser.newEvents(ctx, query, args, insertIDs, event)
+	case SqliteDB:
+		events, err = a.parser.SqliteParser.newEvents(ctx, query, args, insertIDs, event)
+	default:
+		return ErrDriverNotSupported
+	}
 	if err != nil {
-		return "", 0, err
+		return err
 	}
 
-	return splits[0], position, nil
+	return a.store.write(ctx, a.applyPolicies(events, a.defaultSchema))
 }
@@ -0,0 +1,249 @@
+package audit
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	ErrWrappedKey   = fmt.Errorf("wrapped data key is too short")
+	ErrNoAuditTable = fmt.Errorf("audit records are not saved in the audit table")
+	ErrKeySize      = fmt.Errorf("key encryption key is not 16, 24 or 32 bytes")
+)
+
+// encryptedKey holds the envelope of encrypted values, as their only key
+const encryptedKey = "_encrypted"
+
+// dataKeySize is the size of the AES-256 key every record is encrypted with.
+const dataKeySize = 32
+
+// KeyEncrypter wraps the data keys that audit records are encrypted with, with a
+// key encryption key kept elsewhere, such as in a KMS.
+type KeyEncrypter interface {
+	// WrapKey encrypts a data key with the current key encryption key, and
+	// gives the id of that key.
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key with the key encryption key of an id.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Record is an event as saved in the audit table, along with its id.
+type Record struct {
+	ID int64
+	Event
+}
+
+// envelope is encrypted values, along with their wrapped data key
+type envelope struct {
+	KeyID string `json:"kid"`
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// KeyWrapper is a KeyEncrypter wrapping data keys with AES-GCM, under the keys
+// of a provider, such as a KeyRing. The keys are 16, 24 or 32 bytes long.
+type KeyWrapper struct {
+	keys KeyProvider
+}
+
+// NewKeyWrapper creates a KeyEncrypter with the keys of the provider. The data
+// keys of new records are wrapped with its current key.
+func NewKeyWrapper(keys KeyProvider) *KeyWrapper {
+	return &KeyWrapper{keys: keys}
+}
+
+// checkKeys tells whether the keys of a key ring are AES keys. Keys of other
+// providers are only known once used.
+func (w *KeyWrapper) checkKeys() error {
+	ring, ok := w.keys.(*KeyRing)
+	if !ok {
+		return nil
+	}
+	for id, key := range ring.keys {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("key %q: %w", id, ErrKeySize)
+		}
+	}
+	return nil
+}
+
+func (w *KeyWrapper) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	id, key, err := w.keys.CurrentKey(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, sealed, err := seal(key, dataKey, []byte(id))
+	if err != nil {
+		return "", nil, err
+	}
+	return id, append(nonce, sealed...), nil
+}
+
+func (w *KeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, err := w.keys.Key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, ErrWrappedKey
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(keyID))
+}
+
+// encrypt encrypts the values of the events, when set up by WithEncryption
+func (s store) encrypt(ctx context.Context, events []Event) error {
+	if s.encrypter == nil {
+		return nil
+	}
+
+	for i, ev := range events {
+		if len(s.encryptedTables) > 0 && (ev.Table == "" || !isExempted(s.encryptedTables, ev.Table, s.defaultSchema)) {
+			continue
+		}
+		if !sealable(ev.OldValues) && !sealable(ev.NewValues) {
+			continue
+		}
+
+		dataKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return err
+		}
+		keyID, wrapped, err := s.encrypter.WrapKey(ctx, dataKey)
+		if err != nil {
+			return err
+		}
+
+		if events[i].OldValues, err = sealValues(dataKey, keyID, wrapped, ev, "old_values", ev.OldValues); err != nil {
+			return err
+		}
+		if events[i].NewValues, err = sealValues(dataKey, keyID, wrapped, ev, "new_values", ev.NewValues); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealable tells whether values have anything to encrypt.
+func sealable(values string) bool {
+	return values != "" && values != "{}"
+}
+
+// sealValues encrypts the values of one column of an event
+func sealValues(dataKey []byte, keyID string, wrapped []byte, ev Event, column, values string) (string, error) {
+	if !sealable(values) {
+		return values, nil
+	}
+
+	nonce, sealed, err := seal(dataKey, []byte(values), sealedData(ev, column))
+	if err != nil {
+		return "", err
+	}
+	marshalled, err := json.Marshal(map[string]envelope{
+		encryptedKey: {KeyID: keyID, Key: wrapped, Nonce: nonce, Data: sealed},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(marshalled), nil
+}
+
+// openValues decrypts values sealed by sealValues. Values that are not
+// encrypted are returned as they are.
+func openValues(ctx context.Context, encrypter KeyEncrypter, ev Event, column, values string) (string, error) {
+	var sealed map[string]envelope
+	if err := json.Unmarshal([]byte(values), &sealed); err != nil || len(sealed) != 1 {
+		return values, nil
+	}
+	env, ok := sealed[encryptedKey]
+	if !ok {
+		return values, nil
+	}
+
+	dataKey, err := encrypter.UnwrapKey(ctx, env.KeyID, env.Key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	opened, err := gcm.Open(nil, env.Nonce, env.Data, sealedData(ev, column))
+	if err != nil {
+		return "", err
+	}
+	return string(opened), nil
+}
+
+// sealedData is the additional data values are sealed with.
+func sealedData(ev Event, column string) []byte {
+	data, _ := json.Marshal([]interface{}{ev.Table, ev.TableRowID, ev.Action, column})
+	return data
+}
+
+func seal(key, plaintext, additionalData []byte) (nonce, sealed []byte, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt decrypts the values of an event read from elsewhere than the audit
+// table
+func Decrypt(ctx context.Context, encrypter KeyEncrypter, ev Event) (Event, error) {
+	var err error
+	if ev.OldValues, err = openValues(ctx, encrypter, ev, "old_values", ev.OldValues); err != nil {
+		return Event{}, err
+	}
+	if ev.NewValues, err = openValues(ctx, encrypter, ev, "new_values", ev.NewValues); err != nil {
+		return Event{}, err
+	}
+	return ev, nil
+}
+
+// Records reads the records of the audit table from id from to to, decrypted
+func (a *Auditor) Records(ctx context.Context, from, to int64) ([]Record, error) {
+	sink, ok := a.store.tableSink()
+	if !ok {
+		return nil, ErrNoAuditTable
+	}
+
+	var records []Record
+	err := sink.records(ctx, from, to, func(id int64, ev Event) error {
+		if a.store.encrypter != nil {
+			var err error
+			if ev, err = Decrypt(ctx, a.store.encrypter, ev); err != nil {
+				return fmt.Errorf("audit record %d: %w", id, err)
+			}
+		}
+		records = append(records, Record{ID: id, Event: ev})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
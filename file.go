@@ -0,0 +1,387 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSinkClosed = fmt.Errorf("audit sink is closed")
+
+// FileSync is when the writes of a file sink are flushed to disk.
+type FileSync int
+
+const (
+	// SyncNone leaves flushing to the operating system.
+	SyncNone FileSync = iota
+	// SyncWrite flushes every write before it returns.
+	SyncWrite
+	// SyncInterval flushes the file every FileConfig.SyncInterval.
+	SyncInterval
+)
+
+// FileConfig sets up a sink writing events to JSON Lines files.
+type FileConfig struct {
+	// Dir is the directory files are written to. It is created if missing.
+	// Defaults to the working directory.
+	Dir string
+	// Name is the prefix of the file names. Defaults to `audit`.
+	Name string
+
+	// MaxSize is the size in bytes a file is rotated at. 0 never rotates by
+	// size.
+	MaxSize int64
+	// RotateEvery is how long a file is written to before it is rotated. The
+	// file is rotated on the first write after that. 0 never rotates by time.
+	RotateEvery time.Duration
+	// Compress gzips files once they are rotated.
+	Compress bool
+	// Retention is how long rotated files are kept, from when they were last
+	// written to. 0 keeps them forever.
+	Retention time.Duration
+
+	// Sync is when writes are flushed to disk.
+	Sync FileSync
+	// SyncInterval is how often SyncInterval flushes. Defaults to one second.
+	SyncInterval time.Duration
+}
+
+const (
+	defaultFileName     = "audit-20060102-150405.000.jsonl"
+	defaultSyncInterval = time.Second
+)
+
+// FileSink appends events to JSON Lines files, rotated by size and age
+type FileSink struct {
+	config FileConfig
+	now    func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// jsonEvent is an event as written to files and webhooks, with its old and new
+// values kept as JSON objects.
+type jsonEvent struct {
+	ActorID    uint64          `json:"actor_id"`
+	TableRowID string          `json:"table_row_id"`
+	Table      string          `json:"table_name"`
+	Action     Action          `json:"action"`
+	OldValues  json.RawMessage `json:"old_values"`
+	NewValues  json.RawMessage `json:"new_values"`
+	HTTPMethod string          `json:"http_method"`
+	URL        string          `json:"url"`
+	IPAddress  string          `json:"ip_address"`
+	UserAgent  string          `json:"user_agent"`
+	CreatedAt  time.Time       `json:"created_at"`
+	PrevHash   string          `json:"prev_hash,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
+	KeyID      string          `json:"key_id,omitempty"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+// NewFileSink creates a sink writing into the directory of the config
+func NewFileSink(config FileConfig) (*FileSink, error) {
+	if config.Dir == "" {
+		config.Dir = "."
+	}
+	if config.Name == "" {
+		config.Name = defaultFileName
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultSyncInterval
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &FileSink{
+		config: config,
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}
+	if err := s.open(s.now()); err != nil {
+		return nil, err
+	}
+	s.background("", s.now())
+
+	if config.Sync == SyncInterval {
+		s.wg.Add(1)
+		go s.syncEvery(config.SyncInterval)
+	}
+
+	return s, nil
+}
+
+// Write appends the events to the file, rotating it first when it is due. The
+// events are written together, so they are never split across two files.
+func (s *FileSink) Write(_ context.Context, events []Event) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if err := encoder.Encode(jsonEventOf(ev)); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	now := s.now()
+	if s.due(now, int64(buf.Len())) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.config.Sync == SyncWrite {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// Close flushes and closes the file, waiting for rotated files to be
+// compressed and removed.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+
+	err := s.file.Sync()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// due tells whether the file is to be rotated before size more bytes are
+// written to it. A file is never rotated while empty.
+func (s *FileSink) due(now time.Time, size int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.config.MaxSize > 0 && s.size+size > s.config.MaxSize {
+		return true
+	}
+	return s.config.RotateEvery > 0 && now.Sub(s.opened) >= s.config.RotateEvery
+}
+
+// rotate closes the file and opens a new one.
+func (s *FileSink) rotate(now time.Time) error {
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := s.path
+
+	if err := s.open(now); err != nil {
+		return err
+	}
+	// a name that has not changed goes on with the same file
+	if s.path != rotated {
+		s.background(rotated, now)
+	}
+
+	return nil
+}
+
+func (s *FileSink) open(now time.Time) error {
+	path := filepath.Join(s.config.Dir, now.Format(s.config.Name))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	s.file = file
+	s.path = path
+	s.size = info.Size()
+	s.opened = now
+	return nil
+}
+
+// background compresses a rotated file, if any, then removes the files past the
+// retention.
+func (s *FileSink) background(rotated string, now time.Time) {
+	compress := rotated != "" && s.config.Compress
+	if !compress && s.config.Retention <= 0 {
+		return
+	}
+
+	active := s.path
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if compress {
+			if err := compressFile(rotated); err != nil {
+				log.Printf("audit: %s not compressed: %v", rotated, err)
+			}
+		}
+		if s.config.Retention > 0 {
+			if err := s.removeExpired(active, now); err != nil {
+				log.Printf("audit: expired files not removed: %v", err)
+			}
+		}
+	}()
+}
+
+// removeExpired removes the files named by the sink that were last written to
+// before the retention, other than the one being written to.
+func (s *FileSink) removeExpired(active string, now time.Time) error {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(s.config.Dir, entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ".gz")
+		if entry.IsDir() || path == active {
+			continue
+		}
+		if _, err := time.Parse(s.config.Name, name); err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) < s.config.Retention {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileSink) syncEvery(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if !s.closed {
+				if err := s.file.Sync(); err != nil {
+					log.Printf("audit: %s not synced: %v", s.path, err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// compressFile gzips a file into one of the same name ending in `.gz`, then
+// removes it.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func jsonEventOf(ev Event) jsonEvent {
+	return jsonEvent{
+		ActorID:    ev.ActorID,
+		TableRowID: ev.TableRowID,
+		Table:      ev.Table,
+		Action:     ev.Action,
+		OldValues:  jsonValue(ev.OldValues),
+		NewValues:  jsonValue(ev.NewValues),
+		HTTPMethod: ev.HTTPMethod,
+		URL:        ev.URL,
+		IPAddress:  ev.IPAddress,
+		UserAgent:  ev.UserAgent,
+		CreatedAt:  ev.CreatedAt,
+		PrevHash:   ev.PrevHash,
+		Hash:       ev.Hash,
+		KeyID:      ev.KeyID,
+		Signature:  ev.Signature,
+	}
+}
+
+// jsonValue keeps values that are already JSON as they are, and writes others
+// as a string.
+func jsonValue(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("{}")
+	}
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	marshalled, _ := json.Marshal(s)
+	return marshalled
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"github.com/qustavo/sqlhooks/v2"
+	"strconv"
 )
 
 // Hooks satisfies the sqlhook.Hooks interface
@@ -30,10 +33,21 @@ func RegisterHooks(auditor *Auditor, dbType string) (string, error) {
 	switch dbType {
 	case MysqlDB:
 		auditor.dbType = MysqlDB
-		sql.Register(databaseDriverName, sqlhooks.Wrap(&mysql.MySQLDriver{}, hooks))
+		sql.Register(databaseDriverName, &transactionDriver{Driver: sqlhooks.Wrap(&mysql.MySQLDriver{}, hooks), auditor: auditor})
 	case PostgresDB:
 		auditor.dbType = PostgresDB
-		sql.Register(databaseDriverName, sqlhooks.Wrap(&pq.Driver{}, hooks))
+		// the auditor is only connected to the database later on
+		primaryKey := func(ctx context.Context, tableName string) ([]string, error) {
+			return auditor.knownPrimaryKeyOf(ctx, tableName)
+		}
+		audited := func(tableName string, action Action) bool {
+			return !isExempted(auditor.tableException, tableName, auditor.defaultSchema) && auditor.audited(tableName, action)
+		}
+		returning := &returningDriver{Driver: &pq.Driver{}, audited: audited, primaryKey: primaryKey, returnAll: auditor.postImage}
+		sql.Register(databaseDriverName, &transactionDriver{Driver: sqlhooks.Wrap(returning, hooks), auditor: auditor})
+	case SqliteDB:
+		auditor.dbType = SqliteDB
+		sql.Register(databaseDriverName, &transactionDriver{Driver: sqlhooks.Wrap(&sqlite3.SQLiteDriver{}, hooks), auditor: auditor})
 
 	default:
 		return "invalid_driver", ErrInvalidDatabaseDriver
@@ -44,15 +58,25 @@ func RegisterHooks(auditor *Auditor, dbType string) (string, error) {
 
 func (h *Hooks) Before(ctx context.Context, query string, args ...interface{}) (context.Context, error) {
 	name, err := h.Auditor.GetTableName(query)
+	if errors.Is(err, ErrSqliteSyntax) {
+		return h.unaudited(ctx, err), nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	var event Event
 
-	isExempted := isExempted(h.Auditor.tableException, name)
-	if err != nil {
-		return ctx, err
+	isExempted := isExempted(h.Auditor.tableException, name, h.Auditor.defaultSchema)
+	if !isExempted && len(h.Auditor.policies) > 0 {
+		action, err := h.Auditor.getAction(query)
+		if errors.Is(err, ErrSqliteSyntax) {
+			return h.unaudited(ctx, err), nil
+		}
+		if err != nil {
+			return ctx, err
+		}
+		isExempted = !h.Auditor.audited(name, action)
 	}
 	event.IsExempted = isExempted
 
@@ -73,10 +97,22 @@ func (h *Hooks) Before(ctx context.Context, query string, args ...interface{}) (
 	return context.WithValue(ctx, "audit", event), nil
 }
 
+// unaudited lets a statement the parser cannot read run without being audited,
+// and reports it to the error handler instead.
+func (h *Hooks) unaudited(ctx context.Context, err error) context.Context {
+	var events []Event
+	if ev, ok := ctx.Value("audit").(Event); ok {
+		events = append(events, ev)
+	}
+	h.Auditor.reportError(err, events)
+
+	return context.WithValue(ctx, "audit", Event{IsExempted: true})
+}
+
 func (h *Hooks) After(ctx context.Context, result driver.Result, rows driver.Rows, query string, args ...interface{}) (context.Context, error) {
 	ev := ctx.Value("audit").(Event)
 
-	var lastInsertID int64
+	var insertIDs []string
 	if !ev.IsExempted {
 		if ev.Action == "insert" {
 			switch h.Auditor.dbType {
@@ -85,13 +121,42 @@ func (h *Hooks) After(ctx context.Context, result driver.Result, rows driver.Row
 				if err != nil {
 					return ctx, err
 				}
-				lastInsertID = id
+				rowsAffected, err := result.RowsAffected()
+				if err != nil {
+					return ctx, err
+				}
+				// the ids of a multi-row insert follow the first one
+				inserted := insertedRows(query, ev.WhereClause, rowsAffected)
+				for i := int64(0); id > 0 && i < inserted; i++ {
+					insertIDs = append(insertIDs, strconv.FormatInt(id+i, 10))
+				}
 			case PostgresDB:
-				lastInsertID = 0
+				insertIDs = returnedIDs(result, rows)
+			case SqliteDB:
+				ids, err := h.Auditor.parser.SqliteParser.insertIDs(ctx, h.Auditor.store, ev, result)
+				if err != nil {
+					return ctx, err
+				}
+				insertIDs = ids
+			}
+		}
+
+		if ev.WhereClause.truncated && result != nil {
+			rowsAffected, err := result.RowsAffected()
+			if err == nil {
+				ev.WhereClause.rowsAffected = rowsAffected
+			}
+		}
+
+		if h.Auditor.postImage && !ev.WhereClause.truncated && (ev.Action == Insert || ev.Action == Update) {
+			postImage, err := h.Auditor.readPostImage(ctx, query, args, result, rows, insertIDs, ev)
+			if err != nil {
+				return nil, err
 			}
+			ev.WhereClause.postImage = postImage
 		}
 
-		err := h.Auditor.Save(ctx, query, args, lastInsertID, ev)
+		err := h.Auditor.Save(ctx, query, args, insertIDs, ev)
 		if err != nil {
 			return nil, err
 		}
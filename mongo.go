@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoSink saves events as documents of a MongoDB collection.
+type mongoSink struct {
+	collection *mongo.Collection
+}
+
+// mongoIndexes are created on the audit collection to look up the history of a
+// row, the changes made by an actor, and changes by time.
+var mongoIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "table_name", Value: 1}, {Key: "table_row_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	{Keys: bson.D{{Key: "created_at", Value: -1}}},
+}
+
+func newMongoSink(ctx context.Context, collection *mongo.Collection) (*mongoSink, error) {
+	_, err := collection.Indexes().CreateMany(ctx, mongoIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongoSink{collection: collection}, nil
+}
+
+func (s *mongoSink) Write(ctx context.Context, events []Event) error {
+	docs := make([]interface{}, 0, len(events))
+	for _, ev := range events {
+		doc, err := mongoDocument(ev)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+
+	_, err := s.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(true))
+	return err
+}
+
+// mongoEvent is an event as stored in MongoDB, with its old and new values as
+// documents of their own.
+type mongoEvent struct {
+	ActorID    uint64    `bson:"actor_id"`
+	TableRowID string    `bson:"table_row_id"`
+	Table      string    `bson:"table_name"`
+	Action     Action    `bson:"action"`
+	OldValues  bson.D    `bson:"old_values"`
+	NewValues  bson.D    `bson:"new_values"`
+	HTTPMethod string    `bson:"http_method"`
+	URL        string    `bson:"url"`
+	IPAddress  string    `bson:"ip_address"`
+	UserAgent  string    `bson:"user_agent"`
+	CreatedAt  time.Time `bson:"created_at"`
+	PrevHash   string    `bson:"prev_hash,omitempty"`
+	Hash       string    `bson:"hash,omitempty"`
+	KeyID      string    `bson:"key_id,omitempty"`
+	Signature  string    `bson:"signature,omitempty"`
+}
+
+func mongoDocument(ev Event) (mongoEvent, error) {
+	oldValues, err := jsonDocument(ev.OldValues)
+	if err != nil {
+		return mongoEvent{}, err
+	}
+	newValues, err := jsonDocument(ev.NewValues)
+	if err != nil {
+		return mongoEvent{}, err
+	}
+
+	return mongoEvent{
+		ActorID:    ev.ActorID,
+		TableRowID: ev.TableRowID,
+		Table:      ev.Table,
+		Action:     ev.Action,
+		OldValues:  oldValues,
+		NewValues:  newValues,
+		HTTPMethod: ev.HTTPMethod,
+		URL:        ev.URL,
+		IPAddress:  ev.IPAddress,
+		UserAgent:  ev.UserAgent,
+		CreatedAt:  ev.CreatedAt,
+		PrevHash:   ev.PrevHash,
+		Hash:       ev.Hash,
+		KeyID:      ev.KeyID,
+		Signature:  ev.Signature,
+	}, nil
+}
+
+// jsonDocument turns a JSON object into a document, keeping the order of its
+// fields.
+func jsonDocument(values string) (bson.D, error) {
+	doc := bson.D{}
+	if values == "" {
+		return doc, nil
+	}
+	if err := bson.UnmarshalExtJSON([]byte(values), false, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
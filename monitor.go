@@ -0,0 +1,455 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoMonitor audits the writes of a MongoDB client from its command monitor
+type MongoMonitor struct {
+	auditor *Auditor
+
+	mu      sync.Mutex
+	client  *mongo.Client
+	pending map[int64]*mongoCommand
+}
+
+// mongoCommand is a write command that has been sent, and the documents it
+// changes as they were before.
+type mongoCommand struct {
+	event      Event
+	name       string
+	database   string
+	collection string
+	command    bson.Raw
+
+	before    []bson.Raw
+	truncated bool
+}
+
+// NewMongoMonitor creates a monitor that audits through the auditor. Without a
+// SQL database set, events are saved into MongoDB with WithMongo.
+func NewMongoMonitor(auditor *Auditor) (*MongoMonitor, error) {
+	if auditor.store.query.table == "" {
+		auditor.store.query.table = auditor.auditTableName
+	}
+	if err := auditor.store.newSink(); err != nil {
+		return nil, err
+	}
+	if err := auditor.store.chainSink(); err != nil {
+		return nil, err
+	}
+	if err := auditor.store.startQueue(); err != nil {
+		return nil, err
+	}
+
+	return &MongoMonitor{
+		auditor: auditor,
+		pending: make(map[int64]*mongoCommand),
+	}, nil
+}
+
+// CommandMonitor is the monitor to set on the client options of the application.
+func (m *MongoMonitor) CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started:   m.started,
+		Succeeded: m.succeeded,
+		Failed:    m.failed,
+	}
+}
+
+// SetClient sets the client documents are read with, which is to be another
+// client than the monitored one
+func (m *MongoMonitor) SetClient(client *mongo.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client = client
+}
+
+func (m *MongoMonitor) started(ctx context.Context, started *event.CommandStartedEvent) {
+	switch started.CommandName {
+	case "insert", "update", "delete", "findAndModify":
+	default:
+		return
+	}
+	collection, ok := started.Command.Lookup(started.CommandName).StringValueOK()
+	if !ok || isExempted(m.auditor.tableException, collection, started.DatabaseName) {
+		return
+	}
+	if policy := policyFor(m.auditor.policies, collection, started.DatabaseName); !policy.audits(mongoAction(started.CommandName)) {
+		return
+	}
+
+	ev, ok := ctx.Value("audit").(Event)
+	if !ok {
+		log.Printf("audit: %s on %s not audited: %v", started.CommandName, collection, ErrNoAuditSet)
+		return
+	}
+	ev.Table = collection
+	cmd := &mongoCommand{
+		event:      ev,
+		name:       started.CommandName,
+		database:   started.DatabaseName,
+		collection: collection,
+		command:    started.Command,
+	}
+
+	// the command is about to be sent, so documents are read outside of its
+	// session
+	if err := m.readBefore(context.Background(), cmd); err != nil {
+		log.Printf("audit: %s on %s not audited: %v", cmd.name, collection, err)
+		return
+	}
+
+	m.mu.Lock()
+	m.pending[started.RequestID] = cmd
+	m.mu.Unlock()
+}
+
+func (m *MongoMonitor) succeeded(ctx context.Context, succeeded *event.CommandSucceededEvent) {
+	cmd := m.take(succeeded.RequestID)
+	if cmd == nil {
+		return
+	}
+
+	events, err := m.newEvents(ctx, cmd, succeeded.Reply)
+	if err == nil {
+		// events are saved apart from the session of the command
+		err = m.auditor.store.write(context.Background(), m.auditor.applyPolicies(events, cmd.database))
+	}
+	if err != nil {
+		log.Printf("audit: %s on %s not audited: %v", cmd.name, cmd.collection, err)
+	}
+}
+
+// mongoAction is the action of a command, if it is known before it runs.
+func mongoAction(command string) Action {
+	switch command {
+	case "insert":
+		return Insert
+	case "delete":
+		return Delete
+	default:
+		// an update may upsert, and findAndModify may also remove
+		return ""
+	}
+}
+
+func (m *MongoMonitor) failed(_ context.Context, failed *event.CommandFailedEvent) {
+	m.take(failed.RequestID)
+}
+
+func (m *MongoMonitor) take(requestID int64) *mongoCommand {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd := m.pending[requestID]
+	delete(m.pending, requestID)
+	return cmd
+}
+
+// readBefore reads the documents a command is about to change, or marks it for
+// a summary
+func (m *MongoMonitor) readBefore(ctx context.Context, cmd *mongoCommand) error {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	if client == nil && cmd.name != "insert" {
+		cmd.truncated = true
+		return nil
+	}
+
+	rowLimit := int64(m.auditor.store.rowLimit)
+	many := int64(0)
+	if rowLimit > 0 {
+		many = rowLimit + 1
+	}
+
+	var statements []bson.Raw
+	switch cmd.name {
+	case "update":
+		statements = arrayDocuments(cmd.command.Lookup("updates"))
+	case "delete":
+		statements = arrayDocuments(cmd.command.Lookup("deletes"))
+	case "findAndModify":
+		statements = []bson.Raw{cmd.command}
+	}
+
+	for _, statement := range statements {
+		var filter bson.Raw
+		var sort interface{}
+		limit := int64(1)
+		switch cmd.name {
+		case "update":
+			filter, _ = statement.Lookup("q").DocumentOK()
+			if multi, _ := statement.Lookup("multi").BooleanOK(); multi {
+				limit = many
+			}
+		case "delete":
+			filter, _ = statement.Lookup("q").DocumentOK()
+			if n, _ := statement.Lookup("limit").AsInt64OK(); n == 0 {
+				limit = many
+			}
+		case "findAndModify":
+			filter, _ = statement.Lookup("query").DocumentOK()
+			if doc, ok := statement.Lookup("sort").DocumentOK(); ok {
+				sort = doc
+			}
+		}
+
+		docs, err := m.find(ctx, cmd, filter, sort, limit)
+		if err != nil {
+			return err
+		}
+		cmd.before = append(cmd.before, docs...)
+		if rowLimit > 0 && int64(len(cmd.before)) > rowLimit {
+			cmd.before = nil
+			cmd.truncated = true
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// newEvents builds the events of a command once it succeeded, reading back the
+// documents it updated or upserted.
+func (m *MongoMonitor) newEvents(ctx context.Context, cmd *mongoCommand, reply bson.Raw) ([]Event, error) {
+	ev := cmd.event
+	ev.CreatedAt = time.Now()
+
+	switch cmd.name {
+	case "insert":
+		ev.Action = Insert
+	case "update":
+		ev.Action = Update
+	case "delete":
+		ev.Action = Delete
+	case "findAndModify":
+		ev.Action = Update
+		if remove, _ := cmd.command.Lookup("remove").BooleanOK(); remove {
+			ev.Action = Delete
+		}
+	}
+
+	if cmd.truncated {
+		ev.OldValues = "{}"
+		n, _ := reply.Lookup("n").AsInt64OK()
+		ev.NewValues = mongoSummary(cmd, n)
+		return []Event{ev}, nil
+	}
+
+	var events []Event
+	if cmd.name == "insert" {
+		// an ordered insert stops at its first error
+		ordered := true
+		if v, ok := cmd.command.Lookup("ordered").BooleanOK(); ok {
+			ordered = v
+		}
+		failed := make(map[int64]bool)
+		first := int64(-1)
+		for _, writeErr := range arrayDocuments(reply.Lookup("writeErrors")) {
+			index, _ := writeErr.Lookup("index").AsInt64OK()
+			failed[index] = true
+			if first < 0 || index < first {
+				first = index
+			}
+		}
+		for i, doc := range arrayDocuments(cmd.command.Lookup("documents")) {
+			if ordered && first >= 0 && int64(i) >= first {
+				break
+			}
+			if failed[int64(i)] {
+				continue
+			}
+			inserted := ev
+			inserted.TableRowID = mongoID(doc.Lookup("_id"))
+			inserted.OldValues = "{}"
+			inserted.NewValues = mongoValues(doc)
+			events = append(events, inserted)
+		}
+		if n, ok := reply.Lookup("n").AsInt64OK(); ok && n < int64(len(events)) {
+			log.Printf("audit: %d documents inserted into %s, not %d", n, cmd.collection, len(events))
+			events = events[:n]
+		}
+		return events, nil
+	}
+
+	if ev.Action == Delete {
+		for _, doc := range cmd.before {
+			deleted := ev
+			deleted.TableRowID = mongoID(doc.Lookup("_id"))
+			deleted.OldValues = mongoValues(doc)
+			deleted.NewValues = "{}"
+			events = append(events, deleted)
+		}
+		return events, nil
+	}
+
+	var ids []interface{}
+	for _, doc := range cmd.before {
+		ids = append(ids, doc.Lookup("_id"))
+	}
+	var upserted []interface{}
+	for _, doc := range arrayDocuments(reply.Lookup("upserted")) {
+		upserted = append(upserted, doc.Lookup("_id"))
+	}
+	if id := reply.Lookup("lastErrorObject", "upserted"); id.Type != 0 {
+		upserted = append(upserted, id)
+	}
+
+	after, err := m.findByID(ctx, cmd, append(ids, upserted...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range cmd.before {
+		updated := ev
+		updated.TableRowID = mongoID(doc.Lookup("_id"))
+		updated.OldValues = mongoValues(doc)
+		updated.NewValues = "{}"
+		if doc, ok := after[updated.TableRowID]; ok {
+			updated.NewValues = mongoValues(doc)
+		}
+		events = append(events, updated)
+	}
+	for _, id := range upserted {
+		inserted := ev
+		inserted.Action = Insert
+		inserted.TableRowID = mongoID(id.(bson.RawValue))
+		inserted.OldValues = "{}"
+		inserted.NewValues = "{}"
+		if doc, ok := after[inserted.TableRowID]; ok {
+			inserted.NewValues = mongoValues(doc)
+		}
+		events = append(events, inserted)
+	}
+
+	return events, nil
+}
+
+func (m *MongoMonitor) find(ctx context.Context, cmd *mongoCommand, filter bson.Raw, sort interface{}, limit int64) ([]bson.Raw, error) {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	if client == nil {
+		return nil, ErrInvalidConnection
+	}
+
+	if filter == nil {
+		filter = bson.Raw{}
+	}
+	opts := options.Find()
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if sort != nil {
+		opts.SetSort(sort)
+	}
+
+	cursor, err := client.Database(cmd.database).Collection(cmd.collection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []bson.Raw
+	for cursor.Next(ctx) {
+		doc := make(bson.Raw, len(cursor.Current))
+		copy(doc, cursor.Current)
+		docs = append(docs, doc)
+	}
+
+	return docs, cursor.Err()
+}
+
+// findByID reads documents by their ids, keyed by mongoID.
+func (m *MongoMonitor) findByID(ctx context.Context, cmd *mongoCommand, ids []interface{}) (map[string]bson.Raw, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	filter, err := bson.Marshal(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, err
+	}
+	docs, err := m.find(ctx, cmd, filter, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]bson.Raw, len(docs))
+	for _, doc := range docs {
+		byID[mongoID(doc.Lookup("_id"))] = doc
+	}
+	return byID, nil
+}
+
+// mongoSummary is the new values of a summary event. Unlike summaryValues, the
+// command is left out, as its documents would bypass redaction and encryption.
+func mongoSummary(cmd *mongoCommand, n int64) string {
+	marshalled, err := json.Marshal(map[string]interface{}{
+		"collection":    cmd.collection,
+		"operation":     cmd.name,
+		"rows_affected": n,
+	})
+	if err != nil {
+		return "{}"
+	}
+	return string(marshalled)
+}
+
+// arrayDocuments gives the documents of an array, leaving out other values.
+func arrayDocuments(value bson.RawValue) []bson.Raw {
+	array, ok := value.ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, err := array.Values()
+	if err != nil {
+		return nil
+	}
+
+	var docs []bson.Raw
+	for _, v := range values {
+		if doc, ok := v.DocumentOK(); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// mongoID is the row id of a document, as its `_id` is written in the audit.
+func mongoID(id bson.RawValue) string {
+	if oid, ok := id.ObjectIDOK(); ok {
+		return oid.Hex()
+	}
+	if s, ok := id.StringValueOK(); ok {
+		return s
+	}
+	if n, ok := id.Int32OK(); ok {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	if n, ok := id.Int64OK(); ok {
+		return strconv.FormatInt(n, 10)
+	}
+	return id.String()
+}
+
+// mongoValues is a document as relaxed extended JSON.
+func mongoValues(doc bson.Raw) string {
+	marshalled, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return "{}"
+	}
+	return string(marshalled)
+}
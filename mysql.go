@@ -5,8 +5,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,54 +16,246 @@ import (
 
 type MysqlParser struct {
 	db       *sql.DB
-	query    query
 	internal *sql.DB
-	parsed   sqlparser.Statement
+
+	uniqueKeys keyCache
 }
 
 func (p *MysqlParser) getTableName(query string) (tableName string, err error) {
-	return getSqlTableName(query)
+	stmt, err := parseMysql(query)
+	if err != nil || stmt == nil {
+		return "", err
+	}
+
+	tables := modifiedTables(stmt)
+	if len(tables) == 0 {
+		return "", nil
+	}
+
+	return tableIdentity(tables[0].table), nil
 }
 
-func getSqlTableName(query string) (tableName string, err error) {
-	query = strings.ToLower(query)
+// parseMysql parses a statement that may write to a table, giving nil for other
+// statements and ErrInvalidQuery for a write after WITH
+func parseMysql(query string) (stmt sqlparser.Statement, err error) {
+	switch firstKeyword(query) {
+	case "insert", "replace", "update", "delete":
+	case "with":
+		switch withStatement(query) {
+		case "insert", "replace", "update", "delete":
+			return nil, ErrInvalidQuery
+		}
+		return nil, nil
+	default:
+		return nil, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			stmt, err = nil, ErrInvalidQuery
+		}
+	}()
 
-	firstSyntax := getSqlAction(query)
+	return sqlparser.Parse(query)
+}
+
+// firstKeyword gives the first word of a query in lowercase, skipping any
+// leading whitespace and comments.
+func firstKeyword(query string) string {
+	for {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(query, "--"), strings.HasPrefix(query, "#"):
+			end := strings.IndexByte(query, '\n')
+			if end < 0 {
+				return ""
+			}
+			query = query[end+1:]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+2:]
+		default:
+			end := strings.IndexFunc(query, func(r rune) bool {
+				return !unicode.IsLetter(r)
+			})
+			if end < 0 {
+				end = len(query)
+			}
+			return strings.ToLower(query[:end])
+		}
+	}
+}
 
-	switch firstSyntax {
-	case "update":
-		tableName = After(query, "update")
-	case "insert":
-		index := regexp.MustCompile("insert(.*?)into").FindStringIndex(query)
-		tableName = after(query, index[1])
-	case "delete":
-		index := regexp.MustCompile("delete(.*?)from").FindStringIndex(query)
-		tableName = after(query, index[1])
+// withStatement is the first keyword of the statement after a WITH clause
+func withStatement(query string) string {
+	depth := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return ""
+			}
+			i += end + 1
+		case depth == 0 && unicode.IsLetter(rune(c)):
+			end := strings.IndexFunc(query[i:], func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+			})
+			if end < 0 {
+				end = len(query) - i
+			}
+			switch word := strings.ToLower(query[i : i+end]); word {
+			case "select", "insert", "replace", "update", "delete":
+				return word
+			}
+			i += end - 1
+		}
 	}
+	return ""
+}
 
-	if tableName == "" {
-		return "", nil
+// modifiedTable is a table a statement writes to, and the name it refers to
+// it by
+type modifiedTable struct {
+	table sqlparser.TableName
+	ref   sqlparser.TableName
+}
+
+// modifiedTables gives the tables a statement writes to
+func modifiedTables(stmt sqlparser.Statement) []modifiedTable {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Insert:
+		return []modifiedTable{{table: stmt.Table}}
+	case *sqlparser.Update:
+		var targets []sqlparser.TableName
+		for _, expr := range stmt.Exprs {
+			targets = append(targets, expr.Name.Qualifier)
+		}
+		return findTables(stmt.TableExprs, targets)
+	case *sqlparser.Delete:
+		return findTables(stmt.TableExprs, stmt.Targets)
+	default:
+		return nil
+	}
+}
+
+// findTables looks up each target in a FROM clause, leaving out repeats. An
+// empty target is the first table.
+func findTables(exprs sqlparser.TableExprs, targets []sqlparser.TableName) []modifiedTable {
+	joined := len(exprs) != 1
+	if !joined {
+		_, single := exprs[0].(*sqlparser.AliasedTableExpr)
+		joined = !single
+	}
+	if len(targets) == 0 {
+		targets = []sqlparser.TableName{{}}
+	}
+
+	var tables []modifiedTable
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		table, as, ok := findTable(exprs, target)
+		if !ok || seen[tableIdentity(table)] {
+			continue
+		}
+		seen[tableIdentity(table)] = true
+
+		modified := modifiedTable{table: table}
+		if joined {
+			modified.ref = table
+			if !as.IsEmpty() {
+				modified.ref = sqlparser.TableName{Name: as}
+			}
+		}
+		tables = append(tables, modified)
+	}
+
+	return tables
+}
+
+// findTable gives the table of a FROM clause that the target names or aliases,
+// along with its alias. An empty target gives the first table.
+func findTable(exprs sqlparser.TableExprs, target sqlparser.TableName) (sqlparser.TableName, sqlparser.TableIdent, bool) {
+	for _, expr := range exprs {
+		switch expr := expr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			table, ok := expr.Expr.(sqlparser.TableName)
+			if !ok {
+				continue
+			}
+			if target.IsEmpty() || tableIdentity(target) == tableIdentity(table) ||
+				(target.Qualifier.IsEmpty() && strings.EqualFold(expr.As.String(), target.Name.String())) {
+				return table, expr.As, true
+			}
+		case *sqlparser.JoinTableExpr:
+			if table, as, ok := findTable(sqlparser.TableExprs{expr.LeftExpr, expr.RightExpr}, target); ok {
+				return table, as, true
+			}
+		case *sqlparser.ParenTableExpr:
+			if table, as, ok := findTable(expr.Exprs, target); ok {
+				return table, as, true
+			}
+		}
 	}
 
-	return strings.ToLower(strings.Trim(tableName, "`")), nil
+	return sqlparser.TableName{}, sqlparser.TableIdent{}, false
+}
+
+// tableIdentity names a table as `schema.table`, or only `table` when the
+// statement does not qualify it.
+func tableIdentity(table sqlparser.TableName) string {
+	name := strings.ToLower(table.Name.String())
+	if table.Qualifier.IsEmpty() {
+		return name
+	}
+	return strings.ToLower(table.Qualifier.String()) + "." + name
 }
 
-func getSqlAction(query string) string {
-	return strings.ToLower(query[:strings.IndexRune(query, ' ')])
+// getSqlAction gives the action of a statement that writes to a table.
+func getSqlAction(stmt sqlparser.Statement) string {
+	switch stmt.(type) {
+	case *sqlparser.Insert:
+		return string(Insert)
+	case *sqlparser.Update:
+		return string(Update)
+	case *sqlparser.Delete:
+		return string(Delete)
+	default:
+		return string(Select)
+	}
 }
 
 func (p *MysqlParser) setEvent(ctx context.Context, s store, auditTableName string, event Event, tableName, query string, args []interface{}) (Event, error) {
-	action := getSqlAction(query)
+	stmt, err := parseMysql(query)
+	if err != nil {
+		return event, err
+	}
+	action := getSqlAction(stmt)
 
 	ww := WhereClause{}
 
 	ww.tableName = tableName
-	sqlAction := getSqlAction(query)
+	sqlAction := action
 
 	if ww.tableName == auditTableName {
 		return Event{}, nil
 	}
 
+	if action != string(Select) {
+		primaryKey, err := s.primaryKeyOf(ctx, tableName)
+		if err != nil {
+			return event, err
+		}
+		ww.primaryKey = primaryKey
+	}
+
 	oldValues, w, err := p.getOldValues(ctx, s, ww, sqlAction, query, args)
 	if err != nil {
 		return event, err
@@ -80,7 +270,6 @@ func (p *MysqlParser) setEvent(ctx context.Context, s store, auditTableName stri
 		fallthrough
 	case string(Delete):
 		event.Action = Action(action)
-		event.TableRowID = w.id
 		event.Table = tableName
 		event.OldValues = oldValues
 		event.WhereClause = w
@@ -100,183 +289,493 @@ func (p *MysqlParser) getOldValues(ctx context.Context, db store, ww WhereClause
 }
 
 func (p *MysqlParser) runQuery(ctx context.Context, s store, ww WhereClause, sqlAction, query string, args []interface{}) (out []byte, w WhereClause, err error) {
-	// todo: support 'IN' operator
 	// todo: support key-value store
 
-	tree, err := sqlparser.Parse(query)
+	tree, err := parseMysql(query)
 	if err != nil {
 		return nil, ww, err
 	}
-	p.parsed = tree
+	if insert, ok := tree.(*sqlparser.Insert); ok {
+		ww, err = p.getConflicts(ctx, s, ww, insert, args)
+		if err != nil {
+			return nil, WhereClause{}, err
+		}
+		return []byte("{}"), ww, nil
+	}
 
-	var name string
-	var position int
-	buf := sqlparser.NewTrackedBuffer(nil)
-	switch sqlAction {
-	case string(Update):
-		sel := tree.(*sqlparser.Update)
-		ww.operator = sel.Where.Expr.(*sqlparser.ComparisonExpr).Operator
-		expr := tree.(*sqlparser.Update).Where.Expr
-		expr.Format(buf)
-	case string(Delete):
-		sel := tree.(*sqlparser.Delete)
-		ww.operator = sel.Where.Expr.(*sqlparser.ComparisonExpr).Operator
-		expr := tree.(*sqlparser.Delete).Where.Expr
-		expr.Format(buf)
+	// every table written to has its rows selected on their own
+	for i, table := range modifiedTables(tree) {
+		w := ww
+		if i > 0 {
+			w = WhereClause{tableName: tableIdentity(table.table)}
+			w.primaryKey, err = s.primaryKeyOf(ctx, w.tableName)
+			if err != nil {
+				return nil, WhereClause{}, err
+			}
+		}
+
+		sel := selectAffected(tree, table.ref, s.rowLimit)
+		if sel == nil {
+			return []byte("{}"), ww, nil
+		}
+		if s.lockRows() {
+			sel.Lock = sqlparser.ForUpdateStr
+		}
+
+		w.query, w.vals, err = p.bindQuery(sel, args)
+		if err != nil {
+			return nil, ww, err
+		}
+
+		w.rows, err = p.queryMarshal(ctx, s, w)
+		if err != nil {
+			return nil, WhereClause{}, err
+		}
+		if !table.ref.IsEmpty() {
+			w.rows = uniqueRows(w.rows)
+		}
+		if s.rowLimit > 0 && len(w.rows) > s.rowLimit {
+			w.truncated = true
+		}
+
+		if i == 0 {
+			ww = w
+		} else {
+			ww.joined = append(ww.joined, w)
+			ww.truncated = ww.truncated || w.truncated
+		}
+	}
+
+	if ww.truncated {
+		ww.rows = nil
+		ww.joined = nil
+	}
+
+	return []byte("{}"), ww, nil
+}
+
+// getConflicts looks up the existing row each row of an upsert conflicts with
+func (p *MysqlParser) getConflicts(ctx context.Context, s store, ww WhereClause, insert *sqlparser.Insert, args []interface{}) (WhereClause, error) {
+	switch {
+	case insert.Action == sqlparser.ReplaceStr:
+		ww.upsert = upsertReplace
+	case len(insert.OnDup) > 0:
+		ww.upsert = upsertUpdate
+	case insert.Ignore != "":
+		ww.upsert = upsertNothing
 	default:
-		return []byte("{}"), ww, nil
+		return ww, nil
 	}
 
-	name, position, err = p.getNameAndWherePosition(buf.String())
-	if err != nil {
-		return nil, ww, err
+	values, ok := insert.Rows.(sqlparser.Values)
+	if !ok {
+		return ww, nil
 	}
-	ww.col = name
-	ww.val = args[position-1]
 
-	marshalled, affectedID, err := p.queryMarshal(ctx, s, ww)
+	keys, err := p.getUniqueKeys(ctx, s, insert.Table)
 	if err != nil {
-		return nil, WhereClause{}, err
+		return ww, err
+	}
+
+	for _, tuple := range values {
+		var conditions []sqlparser.Expr
+		for _, key := range keys {
+			var matches sqlparser.Expr
+			for _, col := range key {
+				val := insertedValue(insert.Columns, tuple, col)
+				if val == nil {
+					matches = nil
+					break
+				}
+				match := &sqlparser.ComparisonExpr{
+					Operator: sqlparser.EqualStr,
+					Left:     &sqlparser.ColName{Name: sqlparser.NewColIdent(col)},
+					Right:    val,
+				}
+				if matches == nil {
+					matches = match
+				} else {
+					matches = &sqlparser.AndExpr{Left: matches, Right: match}
+				}
+			}
+			if matches != nil {
+				conditions = append(conditions, &sqlparser.ParenExpr{Expr: matches})
+			}
+		}
+
+		if len(conditions) == 0 {
+			ww.conflicts = append(ww.conflicts, nil)
+			continue
+		}
+
+		where := conditions[0]
+		for _, condition := range conditions[1:] {
+			where = &sqlparser.OrExpr{Left: where, Right: condition}
+		}
+		sel := &sqlparser.Select{
+			SelectExprs: sqlparser.SelectExprs{&sqlparser.StarExpr{}},
+			From:        sqlparser.TableExprs{&sqlparser.AliasedTableExpr{Expr: insert.Table}},
+			Where:       sqlparser.NewWhere(sqlparser.WhereStr, where),
+			Limit:       &sqlparser.Limit{Rowcount: sqlparser.NewIntVal([]byte("1"))},
+		}
+		if s.lockRows() {
+			sel.Lock = sqlparser.ForUpdateStr
+		}
+
+		lookup := WhereClause{primaryKey: ww.primaryKey}
+		lookup.query, lookup.vals, err = p.bindQuery(sel, args)
+		if err != nil {
+			return ww, err
+		}
+		rows, err := p.queryMarshal(ctx, s, lookup)
+		if err != nil {
+			return ww, err
+		}
+
+		var conflict *row
+		if len(rows) > 0 {
+			conflict = &rows[0]
+		}
+		ww.conflicts = append(ww.conflicts, conflict)
 	}
-	ww.id = affectedID
+
+	return ww, nil
+}
+
+// insertedRows counts the rows an INSERT adds, leaving out those of an upsert
+// that already existed
+func insertedRows(query string, ww WhereClause, rowsAffected int64) int64 {
+	stmt, err := parseMysql(query)
 	if err != nil {
-		return nil, ww, err
+		return rowsAffected
+	}
+	insert, ok := stmt.(*sqlparser.Insert)
+	if !ok {
+		return rowsAffected
+	}
+	values, ok := insert.Rows.(sqlparser.Values)
+	if !ok {
+		if ww.upsert != upsertNone {
+			return 0
+		}
+		return rowsAffected
 	}
 
-	return marshalled, ww, nil
+	var inserted int64
+	for i := range values {
+		if ww.upsert == upsertReplace || i >= len(ww.conflicts) || ww.conflicts[i] == nil {
+			inserted++
+		}
+	}
+	return inserted
 }
 
-func (p *MysqlParser) getNameAndWherePosition(s string) (name string, position int, err error) {
-	splits := strings.Split(s, " ")
-	named := splits[2]
+// insertedValue gives the value a row of an INSERT has for the column, as long
+// as it is a placeholder or a literal.
+func insertedValue(columns sqlparser.Columns, tuple sqlparser.ValTuple, col string) *sqlparser.SQLVal {
+	for i, column := range columns {
+		if !column.EqualString(col) || i >= len(tuple) {
+			continue
+		}
+		val, _ := tuple[i].(*sqlparser.SQLVal)
+		return val
+	}
+	return nil
+}
+
+// getUniqueKeys reads the columns of the table's primary key and unique indexes.
+func (p *MysqlParser) getUniqueKeys(ctx context.Context, s store, table sqlparser.TableName) ([][]string, error) {
+	name := sqlparser.String(table)
+	if keys, ok := p.uniqueKeys.get(name); ok {
+		return keys, nil
+	}
+	if s.dbType == SqliteDB {
+		keys, err := sqliteUniqueKeys(ctx, s, table)
+		if err != nil {
+			return nil, err
+		}
+		p.uniqueKeys.set(name, keys)
+		return keys, nil
+	}
 
-	position, err = strconv.Atoi(named[2:])
+	rows, err := s.sql.QueryContext(ctx, `SELECT INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ? AND NON_UNIQUE = 0
+		ORDER BY INDEX_NAME, SEQ_IN_INDEX`, table.Qualifier.String(), table.Name.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]string
+	var last string
+	for rows.Next() {
+		var index, column string
+		if err = rows.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		if index != last || len(keys) == 0 {
+			keys = append(keys, nil)
+			last = index
+		}
+		keys[len(keys)-1] = append(keys[len(keys)-1], column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-	name = splits[0]
+	p.uniqueKeys.set(name, keys)
 
-	return name, position, err
+	return keys, nil
 }
 
-func (p *MysqlParser) queryMarshal(ctx context.Context, s store, ww WhereClause) ([]byte, uint64, error) {
-	var affectedID uint64 // todo: id can be a string
+// readRows selects the rows of a table with the given ids.
+func (p *MysqlParser) readRows(ctx context.Context, s store, tableName string, primaryKey []string, ids []string) ([]row, error) {
+	schema, name := splitTableName(tableName)
+	table := sqlparser.TableName{Name: sqlparser.NewTableIdent(name), Qualifier: sqlparser.NewTableIdent(schema)}
+	from := sqlparser.TableExprs{&sqlparser.AliasedTableExpr{Expr: table}}
 
-	query := fmt.Sprintf(p.query.selectStmt, ww.tableName, ww.col, ww.operator)
-	rows, err := s.sql.QueryContext(ctx, query, ww.val)
-	if err != nil {
-		return nil, affectedID, err
+	var args []interface{}
+	arg := func(val string) sqlparser.Expr {
+		args = append(args, val)
+		return sqlparser.NewValArg([]byte(fmt.Sprintf(":v%d", len(args))))
+	}
+
+	var where sqlparser.Expr
+	if len(primaryKey) == 1 {
+		in := make(sqlparser.ValTuple, 0, len(ids))
+		for _, id := range ids {
+			in = append(in, arg(id))
+		}
+		where = &sqlparser.ComparisonExpr{
+			Operator: sqlparser.InStr,
+			Left:     &sqlparser.ColName{Name: sqlparser.NewColIdent(primaryKey[0])},
+			Right:    in,
+		}
+	} else {
+		for _, id := range ids {
+			key, err := keyValues(id, primaryKey)
+			if err != nil {
+				return nil, err
+			}
+
+			var matches sqlparser.Expr
+			for _, col := range primaryKey {
+				match := &sqlparser.ComparisonExpr{
+					Operator: sqlparser.EqualStr,
+					Left:     &sqlparser.ColName{Name: sqlparser.NewColIdent(col)},
+					Right:    arg(key[col]),
+				}
+				if matches == nil {
+					matches = match
+				} else {
+					matches = &sqlparser.AndExpr{Left: matches, Right: match}
+				}
+			}
+			if where == nil {
+				where = &sqlparser.ParenExpr{Expr: matches}
+			} else {
+				where = &sqlparser.OrExpr{Left: where, Right: &sqlparser.ParenExpr{Expr: matches}}
+			}
+		}
 	}
-	cols, err := rows.Columns()
+
+	sel := &sqlparser.Select{
+		SelectExprs: sqlparser.SelectExprs{&sqlparser.StarExpr{}},
+		From:        from,
+		Where:       sqlparser.NewWhere(sqlparser.WhereStr, where),
+	}
+
+	var err error
+	ww := WhereClause{primaryKey: primaryKey}
+	ww.query, ww.vals, err = p.bindQuery(sel, args)
 	if err != nil {
-		return nil, affectedID, err
+		return nil, err
+	}
+
+	return p.queryMarshal(ctx, s, ww)
+}
+
+// getPrimaryKey reads the primary key columns of a table from the database.
+func (p *MysqlParser) getPrimaryKey(ctx context.Context, s store, tableName string) ([]string, error) {
+	var schema string
+	name := strings.ReplaceAll(tableName, "`", "")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		schema, name = name[:i], name[i+1:]
 	}
-	vals := make([]interface{}, len(cols))
-	toString := make(map[string]string, len(cols))
-	for i := range cols {
-		vals[i] = new(sql.RawBytes)
+
+	rows, err := s.internal.QueryContext(ctx, `SELECT COLUMN_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ? AND INDEX_NAME = 'PRIMARY'
+		ORDER BY SEQ_IN_INDEX`, schema, name)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var columns []string
 	for rows.Next() {
-		_ = rows.Scan(vals...)
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
 	}
 
-	for i, val := range vals {
-		content := reflect.ValueOf(val).Interface().(*sql.RawBytes)
-		toString[cols[i]] = string(*content)
-		if cols[i] == "id" { // todo: customise table id name
-			affectedID, err = strconv.ParseUint(toString[cols[i]], 10, 64)
-			if err != nil {
-				return nil, 0, err
-			}
+	return columns, rows.Err()
+}
+
+// selectAffected builds a SELECT of the rows a statement writes to in a table
+func selectAffected(tree sqlparser.Statement, ref sqlparser.TableName, rowLimit int) *sqlparser.Select {
+	sel := &sqlparser.Select{
+		SelectExprs: sqlparser.SelectExprs{&sqlparser.StarExpr{TableName: ref}},
+	}
+	switch stmt := tree.(type) {
+	case *sqlparser.Update:
+		sel.From = stmt.TableExprs
+		sel.Where = stmt.Where
+		sel.OrderBy = stmt.OrderBy
+		sel.Limit = stmt.Limit
+	case *sqlparser.Delete:
+		sel.From = stmt.TableExprs
+		sel.Where = stmt.Where
+		sel.OrderBy = stmt.OrderBy
+		sel.Limit = stmt.Limit
+	default:
+		return nil
+	}
+
+	if sel.Limit == nil && rowLimit > 0 {
+		sel.Limit = &sqlparser.Limit{
+			Rowcount: sqlparser.NewIntVal([]byte(strconv.Itoa(rowLimit + 1))),
 		}
 	}
 
-	marshaled, err := json.Marshal(toString)
+	return sel
+}
+
+// bindQuery renders a statement with its placeholders and their arguments
+func (p *MysqlParser) bindQuery(node sqlparser.SQLNode, args []interface{}) (string, []interface{}, error) {
+	var vals []interface{}
+	var err error
+
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		val, ok := node.(*sqlparser.SQLVal)
+		if !ok || val.Type != sqlparser.ValArg {
+			node.Format(buf)
+			return
+		}
+
+		position, e := p.getWherePosition(string(val.Val))
+		if e != nil {
+			err = e
+			return
+		}
+		if position < 1 || position > len(args) {
+			err = ErrInvalidQuery
+			return
+		}
+		vals = append(vals, args[position-1])
+		buf.WriteString("?")
+	})
+	buf.Myprintf("%v", node)
 	if err != nil {
-		return nil, affectedID, err
+		return "", nil, err
 	}
-	return marshaled, affectedID, nil
+
+	return buf.String(), vals, nil
+}
+
+func (p *MysqlParser) getWherePosition(s string) (position int, err error) {
+	return strconv.Atoi(strings.TrimPrefix(s, ":v"))
+}
+
+func (p *MysqlParser) queryMarshal(ctx context.Context, s store, ww WhereClause) ([]row, error) {
+	conn, ok, err := s.readConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return conn.queryRows(ctx, ww.query, ww.vals, ww.primaryKey)
+	}
+
+	rows, err := s.sql.QueryContext(ctx, ww.query, ww.vals...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRows(rows, ww.primaryKey)
 }
 
-func (p *MysqlParser) Save(ctx context.Context, query string, args []interface{}, lastInsertID int64, event Event) error {
-	var e error
-	query = strings.ToLower(query)
+// newEvents builds the events a statement is audited as, one for every row it
+// wrote to.
+func (p *MysqlParser) newEvents(ctx context.Context, query string, args []interface{}, insertIDs []string, event Event) ([]Event, error) {
+	if event.WhereClause.truncated {
+		event.OldValues = "{}"
+		event.NewValues = summaryValues(query, event.WhereClause.rowsAffected)
+		event.CreatedAt = time.Now()
+		return []Event{event}, nil
+	}
 
+	var events []Event
 	switch event.Action {
 	case Insert:
-		event = p.setNewInsertValues(ctx, event, lastInsertID, query, args)
-
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		inserted, err := p.setNewInsertValues(ctx, event, insertIDs, query, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range inserted {
+			events = append(events, withPostImage(ev))
+		}
 	case Update:
-		event = p.setNewUpdateValues(ctx, event, query, args)
-
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		for _, w := range event.WhereClause.targets() {
+			target := event
+			target.Table = w.tableName
+			for _, r := range w.rows {
+				ev, err := p.setNewUpdateValues(ctx, target, r, query, args)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, withPostImage(ev))
+			}
+		}
 	case Select:
-		e = nil
 	case Delete:
-		event.NewValues = "{}"
-		event.CreatedAt = time.Now()
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		for _, w := range event.WhereClause.targets() {
+			target := event
+			target.Table = w.tableName
+			for _, r := range w.rows {
+				ev := target
+				ev.TableRowID = r.id
+				ev.OldValues = r.oldValues
+				ev.NewValues = "{}"
+				ev.CreatedAt = time.Now()
+				events = append(events, ev)
+			}
+		}
 	default:
-		e = ErrInvalidConnection
+		return nil, ErrInvalidConnection
 	}
 
-	return e
+	return events, nil
 }
 
-func (p *MysqlParser) setNewInsertValues(ctx context.Context, event Event, lastInsertID int64, query string, args []interface{}) Event {
-	marshalled, err := p.marshalInsertQuery(query, lastInsertID, args)
+// setNewInsertValues builds an event for every row of an INSERT
+func (p *MysqlParser) setNewInsertValues(ctx context.Context, event Event, insertIDs []string, query string, args []interface{}) ([]Event, error) {
+	inserted, updated, err := p.insertValues(query, insertIDs, args)
 	if err != nil {
-		return Event{}
+		return nil, err
 	}
-	event.TableRowID = uint64(lastInsertID)
-	event.NewValues = string(marshalled)
-	event.CreatedAt = time.Now()
 
-	return event
+	return insertEvents(event, inserted, updated, insertIDs, false)
 }
 
-func (p *MysqlParser) setNewUpdateValues(ctx context.Context, event Event, query string, args []interface{}) Event {
-	newValues, err := p.marshallFromUpdateQueryArgs(query, args)
+func (p *MysqlParser) setNewUpdateValues(ctx context.Context, event Event, r row, query string, args []interface{}) (Event, error) {
+	event.TableRowID = r.id
+	event.OldValues = r.oldValues
+
+	newValues, err := p.marshallFromUpdateQueryArgs(r, event.Table, query, args)
 	if err != nil {
-		return event
+		return Event{}, err
 	}
 	event.NewValues = string(newValues)
 	event.CreatedAt = time.Now()
@@ -286,50 +785,91 @@ func (p *MysqlParser) setNewUpdateValues(ctx context.Context, event Event, query
 		event.ActorID = val
 	}
 
-	return event
+	return event, nil
 }
 
-func (p *MysqlParser) marshalInsertQuery(query string, lastInsertID int64, args []interface{}) ([]byte, error) {
-	toString := make(map[string]interface{}, len(args)+1)
-
-	columnNames := getColumnNamesFromInsert(query)
-	for i, col := range columnNames {
-		toString[col] = args[i]
+// insertValues gives the values of every row of an INSERT, and of its
+// `ON DUPLICATE KEY UPDATE`
+func (p *MysqlParser) insertValues(query string, insertIDs []string, args []interface{}) (inserted, updated []map[string]interface{}, err error) {
+	tree, err := parseMysql(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	insert, ok := tree.(*sqlparser.Insert)
+	if !ok {
+		return nil, nil, ErrInvalidQuery
 	}
 
-	toString["id"] = lastInsertID
+	// rows of an `INSERT ... SELECT` are not known, so only their ids are kept
+	values, ok := insert.Rows.(sqlparser.Values)
+	if !ok {
+		for range insertIDs {
+			inserted = append(inserted, make(map[string]interface{}))
+		}
+		return inserted, nil, nil
+	}
 
-	marshalled, err := json.Marshal(toString)
-	if err != nil {
-		return nil, err
+	for _, tuple := range values {
+		toString := make(map[string]interface{}, len(insert.Columns)+1)
+		for j, col := range insert.Columns {
+			if j >= len(tuple) {
+				break
+			}
+			val, err := p.getValue(tuple[j], args)
+			if err != nil {
+				return nil, nil, err
+			}
+			toString[col.String()] = val
+		}
+		inserted = append(inserted, toString)
+
+		toUpdate := make(map[string]interface{}, len(insert.OnDup))
+		for _, expr := range insert.OnDup {
+			col := expr.Name.Name.String()
+			if ref, ok := expr.Expr.(*sqlparser.ValuesFuncExpr); ok {
+				toUpdate[col] = toString[ref.Name.String()]
+				continue
+			}
+			val, err := p.getValue(expr.Expr, args)
+			if err != nil {
+				return nil, nil, err
+			}
+			toUpdate[col] = val
+		}
+		updated = append(updated, toUpdate)
 	}
 
-	return marshalled, nil
+	return inserted, updated, nil
 }
 
-func (p *MysqlParser) marshallFromUpdateQueryArgs(query string, args []interface{}) ([]byte, error) {
-	sel := p.parsed.(*sqlparser.Update)
-
-	buf := sqlparser.NewTrackedBuffer(nil)
-	sel.Format(buf)
-	name, position, err := getNameAndWherePositionForUpdate(buf.String())
+// marshallFromUpdateQueryArgs gives the values an UPDATE sets on a row of the
+// table. Over joined tables, only the columns of that table are kept.
+func (p *MysqlParser) marshallFromUpdateQueryArgs(r row, tableName, query string, args []interface{}) ([]byte, error) {
+	tree, err := parseMysql(query)
 	if err != nil {
 		return nil, err
 	}
-	wc := WhereClause{
-		col:      name,
-		operator: sel.Where.Expr.(*sqlparser.ComparisonExpr).Operator,
-		val:      args[position-1],
+	upd, ok := tree.(*sqlparser.Update)
+	if !ok {
+		return nil, ErrInvalidQuery
 	}
 
-	toString := make(map[string]interface{}, len(args)+1)
+	toString := make(map[string]interface{}, len(upd.Exprs)+1)
+	for _, expr := range upd.Exprs {
+		table, _, ok := findTable(upd.TableExprs, expr.Name.Qualifier)
+		if !ok || tableIdentity(table) != tableName {
+			continue
+		}
 
-	columnNames := getColumnNamesFromUpdate(query)
-	for i, col := range columnNames {
-		col = strings.ReplaceAll(col, "`", "")
-		toString[col] = args[i]
+		val, err := p.getValue(expr.Expr, args)
+		if err != nil {
+			return nil, err
+		}
+		toString[expr.Name.Name.String()] = val
+	}
+	for col, val := range r.key {
+		toString[col] = val
 	}
-	toString[wc.col] = wc.val
 
 	marshalled, err := json.Marshal(toString)
 	if err != nil {
@@ -339,6 +879,37 @@ func (p *MysqlParser) marshallFromUpdateQueryArgs(query string, args []interface
 	return marshalled, nil
 }
 
+// getValue resolves a value of the query, looking up placeholders from the
+// query args.
+func (p *MysqlParser) getValue(expr sqlparser.Expr, args []interface{}) (interface{}, error) {
+	val, ok := expr.(*sqlparser.SQLVal)
+	switch {
+	case ok && val.Type == sqlparser.ValArg:
+		position, err := p.getWherePosition(string(val.Val))
+		if err != nil {
+			return nil, err
+		}
+		if position < 1 || position > len(args) {
+			return nil, ErrInvalidQuery
+		}
+		return args[position-1], nil
+	case ok:
+		return string(val.Val), nil
+	default:
+		// expressions such as `NOW()` or `balance - ?` are kept as written
+		written, _, err := p.bindQuery(expr, args)
+		if err != nil {
+			return nil, err
+		}
+		return written, nil
+	}
+}
+
+// After gives the word that follows word in query, such as the table after
+// "into".
+//
+// Deprecated: tables are now read from the parsed statement, see
+// Auditor.GetTableName.
 func After(query, word string) string {
 	iWord := strings.Index(query, strings.ToLower(word)) + len(word) + 1
 	return after(query, iWord)
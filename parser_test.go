@@ -0,0 +1,1064 @@
+package audit
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/blastrain/vitess-sqlparser/sqlparser"
+	pg_query "github.com/pganalyze/pg_query_go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMysqlTableName(t *testing.T) {
+	tests := []struct {
+		query  string
+		want   string
+		action string
+	}{
+		{query: "UPDATE users SET email = ? WHERE id = ?", want: "users", action: "update"},
+		{query: "  /* audited */ DELETE FROM billing.invoices WHERE id = ?", want: "billing.invoices", action: "delete"},
+		{query: "-- note\nINSERT INTO `Invoices_2021` (id) VALUES (?)", want: "invoices_2021", action: "insert"},
+		{query: "REPLACE INTO users (email) VALUES (?)", want: "users", action: "insert"},
+		{query: "DELETE t FROM posts p JOIN tags t ON t.post_id = p.id WHERE p.id = ?", want: "tags", action: "delete"},
+		{query: "UPDATE users u JOIN orders o ON o.user_id = u.id SET u.status = ?", want: "users", action: "update"},
+		{query: "SELECT * FROM users", want: ""},
+		{query: "SHOW TABLES", want: ""},
+		{query: "COMMIT", want: ""},
+		{query: "WITH recent AS (SELECT id FROM users WHERE `update` > ?) SELECT * FROM recent", want: ""},
+	}
+
+	p := &MysqlParser{}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := p.getTableName(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			if tt.action != "" {
+				stmt, err := parseMysql(tt.query)
+				require.NoError(t, err)
+				assert.Equal(t, tt.action, getSqlAction(stmt))
+			}
+		})
+	}
+}
+
+func TestWithStatement(t *testing.T) {
+	for _, query := range []string{
+		"WITH stale AS (SELECT id FROM users WHERE seen < ?) DELETE FROM users WHERE id IN (SELECT id FROM stale)",
+		"with recursive a (n) as (select 1), b as (select ')') update users join a on a.n = users.id set users.seen = now()",
+	} {
+		_, err := (&MysqlParser{}).getTableName(query)
+		assert.ErrorIs(t, err, ErrInvalidQuery, query)
+	}
+
+	for _, query := range []string{
+		"WITH stale AS (SELECT id FROM sessions) DELETE FROM sessions WHERE id IN (SELECT id FROM stale)",
+		"WITH moved AS (SELECT id FROM users WHERE seen < $1) UPDATE users SET active = false FROM moved WHERE users.id = moved.id",
+		"WITH d AS (DELETE FROM sessions WHERE expires < now() RETURNING *) SELECT count(*) FROM d",
+		"WITH a AS (WITH b AS (INSERT INTO tags (name) VALUES ('x') RETURNING id) SELECT id FROM b) SELECT * FROM a",
+	} {
+		_, err := (&PostgresParser{}).getTableName(query)
+		assert.ErrorIs(t, err, ErrInvalidQuery, query)
+	}
+
+	got, err := (&PostgresParser{}).getTableName("WITH recent AS (SELECT id FROM users) SELECT * FROM recent")
+	assert.NoError(t, err)
+	assert.Equal(t, "", got)
+}
+
+func TestPostgresTableName(t *testing.T) {
+	tests := []struct {
+		query  string
+		want   string
+		action string
+	}{
+		{query: "UPDATE users SET email = $1 WHERE id = $2", want: "users", action: "update"},
+		{query: "  /* audited */ DELETE FROM billing.invoices WHERE id = $1", want: "billing.invoices", action: "delete"},
+		{query: `INSERT INTO "Invoices_2021" (id) VALUES ($1)`, want: "Invoices_2021", action: "insert"},
+		{query: "SELECT * FROM users", want: "", action: "select"},
+		{query: "BEGIN", want: "", action: "select"},
+	}
+
+	p := &PostgresParser{}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := p.getTableName(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			stmt, err := parsePostgres(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.action, getPostgresAction(stmt))
+		})
+	}
+}
+
+func TestSqliteQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		table string
+	}{
+		{query: `UPDATE "Users" SET email = ? WHERE id = ?`, want: "UPDATE `Users` SET email = ? WHERE id = ?", table: "users"},
+		{query: "DELETE FROM [main].[users] WHERE email = 'a \"b\"'", want: "DELETE FROM `main`.`users` WHERE email = 'a \"b\"'", table: "main.users"},
+		{query: "INSERT OR REPLACE INTO users (id) VALUES (?)", want: "REPLACE INTO users (id) VALUES (?)", table: "users"},
+		{query: "INSERT OR IGNORE INTO users (id) VALUES (?)", want: "INSERT IGNORE INTO users (id) VALUES (?)", table: "users"},
+		{query: "insert into users (id) values (?) on conflict do nothing", want: "INSERT IGNORE into users (id) values (?) ", table: "users"},
+		{
+			query: "INSERT INTO users (id, email) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET email = excluded.email, seen = seen + 1",
+			want:  "INSERT INTO users (id, email) VALUES (?, ?) ON DUPLICATE KEY UPDATE email = VALUES(email), seen = seen + 1",
+			table: "users",
+		},
+		{query: "SELECT \"on conflict\" FROM users", want: "SELECT `on conflict` FROM users"},
+	}
+
+	p := &SqliteParser{MysqlParser: &MysqlParser{}}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.want, sqliteQuery(tt.query))
+
+			got, err := p.getTableName(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.table, got)
+		})
+	}
+}
+
+func TestSqliteParameters(t *testing.T) {
+	tests := map[string]bool{
+		"UPDATE users SET email = ? WHERE id = ?":               false,
+		"UPDATE users SET email = ':name' WHERE note = '@a $b'": false,
+		"UPDATE users SET email = :email WHERE id = :id":        true,
+		"UPDATE users SET email = @email WHERE id = @id":        true,
+		"UPDATE users SET email = $email WHERE id = $id":        true,
+		"UPDATE users SET email = ?2 WHERE id = ?1":             true,
+	}
+	for query, want := range tests {
+		assert.Equal(t, want, hasSqliteParameters(query), query)
+	}
+
+	p := &SqliteParser{MysqlParser: &MysqlParser{}}
+	_, err := p.setEvent(context.Background(), store{}, "audits", Event{}, "users", "DELETE FROM users WHERE id = :id", []interface{}{int64(1)})
+	assert.ErrorIs(t, err, ErrSqliteParameters)
+}
+
+func TestMysqlBindQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		limit int
+		lock  bool
+		args  []interface{}
+		want  string
+		vals  []interface{}
+	}{
+		{
+			name:  "equal",
+			query: "DELETE FROM users WHERE id = ?",
+			args:  []interface{}{int64(1)},
+			want:  "select * from users where id = ?",
+			vals:  []interface{}{int64(1)},
+		},
+		{
+			name:  "in",
+			query: "DELETE FROM sessions WHERE id IN (?, ?, ?)",
+			args:  []interface{}{int64(1), int64(2), int64(3)},
+			want:  "select * from sessions where id in (?, ?, ?)",
+			vals:  []interface{}{int64(1), int64(2), int64(3)},
+		},
+		{
+			name:  "and",
+			query: "UPDATE users SET email = ? WHERE tenant_id = ? AND id = ?",
+			args:  []interface{}{"a@example.com", int64(7), int64(1)},
+			want:  "select * from users where tenant_id = ? and id = ?",
+			vals:  []interface{}{int64(7), int64(1)},
+		},
+		{
+			name:  "is null and range",
+			query: "DELETE FROM users WHERE deleted_at IS NULL AND created_at < ? LIMIT 10",
+			args:  []interface{}{"2021-01-01"},
+			want:  "select * from users where deleted_at is null and created_at < ? limit 10",
+			vals:  []interface{}{"2021-01-01"},
+		},
+		{
+			name:  "no where",
+			query: "UPDATE settings SET enabled = ?",
+			args:  []interface{}{true},
+			want:  "select * from settings",
+		},
+		{
+			name:  "no where with row limit",
+			query: "DELETE FROM cart_items",
+			limit: 100,
+			want:  "select * from cart_items limit 101",
+		},
+		{
+			name:  "update join",
+			query: "UPDATE orders o JOIN customers c ON c.id = o.customer_id SET o.tier = ? WHERE c.country = ?",
+			args:  []interface{}{"gold", "MY"},
+			want:  "select o.* from orders as o join customers as c on c.id = o.customer_id where c.country = ?",
+			vals:  []interface{}{"MY"},
+		},
+		{
+			name:  "delete join",
+			query: "DELETE t FROM posts p JOIN tags t ON t.post_id = p.id WHERE p.id = ?",
+			args:  []interface{}{int64(1)},
+			want:  "select t.* from posts as p join tags as t on t.post_id = p.id where p.id = ?",
+			vals:  []interface{}{int64(1)},
+		},
+		{
+			name:  "locked",
+			query: "DELETE FROM users WHERE id = ?",
+			limit: 100,
+			lock:  true,
+			args:  []interface{}{int64(1)},
+			want:  "select * from users where id = ? limit 101 for update",
+			vals:  []interface{}{int64(1)},
+		},
+	}
+
+	p := &MysqlParser{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := sqlparser.Parse(tt.query)
+			require.NoError(t, err)
+
+			tables := modifiedTables(tree)
+			require.NotEmpty(t, tables)
+
+			sel := selectAffected(tree, tables[0].ref, tt.limit)
+			require.NotNil(t, sel)
+			if tt.lock {
+				sel.Lock = sqlparser.ForUpdateStr
+			}
+
+			got, vals, err := p.bindQuery(sel, tt.args)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.vals, vals)
+		})
+	}
+}
+
+func TestMysqlModifiedTables(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+		refs  []string
+	}{
+		{query: "UPDATE users SET email = ?", want: []string{"users"}, refs: []string{""}},
+		{query: "UPDATE orders o JOIN customers c ON c.id = o.customer_id SET o.tier = ?", want: []string{"orders"}, refs: []string{"o"}},
+		{query: "UPDATE orders o JOIN customers c ON c.id = o.customer_id SET o.tier = ?, c.tier = o.tier", want: []string{"orders", "customers"}, refs: []string{"o", "c"}},
+		{query: "UPDATE orders, customers SET customers.tier = ? WHERE customers.id = orders.customer_id", want: []string{"customers"}, refs: []string{"customers"}},
+		{query: "DELETE a, b FROM a JOIN b ON b.a_id = a.id", want: []string{"a", "b"}, refs: []string{"a", "b"}},
+		{query: "DELETE FROM sessions WHERE id = ?", want: []string{"sessions"}, refs: []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			tree, err := sqlparser.Parse(tt.query)
+			require.NoError(t, err)
+
+			var got, refs []string
+			for _, table := range modifiedTables(tree) {
+				got = append(got, tableIdentity(table.table))
+				refs = append(refs, sqlparser.String(table.ref))
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.refs, refs)
+		})
+	}
+}
+
+func TestPostgresBindQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		limit int
+		lock  bool
+		args  []interface{}
+		want  string
+		vals  []interface{}
+	}{
+		{
+			name:  "equal",
+			query: "DELETE FROM users WHERE id = $1",
+			args:  []interface{}{int64(1)},
+			want:  "SELECT * FROM users WHERE id = $1",
+			vals:  []interface{}{int64(1)},
+		},
+		{
+			name:  "any",
+			query: "UPDATE orders SET status = $1 WHERE id = ANY($2)",
+			args:  []interface{}{"paid", "{1,2}"},
+			want:  "SELECT * FROM orders WHERE id = ANY($1)",
+			vals:  []interface{}{"{1,2}"},
+		},
+		{
+			name:  "in",
+			query: "DELETE FROM sessions WHERE id IN ($1, $2)",
+			args:  []interface{}{int64(1), int64(2)},
+			want:  "SELECT * FROM sessions WHERE id IN ($1, $2)",
+			vals:  []interface{}{int64(1), int64(2)},
+		},
+		{
+			name:  "and or is null",
+			query: "UPDATE users SET email = $1 WHERE (tenant_id = $2 OR tenant_id = $2) AND deleted_at IS NULL",
+			args:  []interface{}{"a@example.com", int64(7)},
+			want:  "SELECT * FROM users WHERE (tenant_id = $1 OR tenant_id = $1) AND deleted_at IS NULL",
+			vals:  []interface{}{int64(7)},
+		},
+		{
+			name:  "no where",
+			query: "UPDATE settings SET enabled = $1",
+			args:  []interface{}{true},
+			want:  "SELECT * FROM settings",
+		},
+		{
+			name:  "no where with row limit",
+			query: "DELETE FROM cart_items",
+			limit: 100,
+			want:  "SELECT * FROM cart_items LIMIT 101",
+		},
+		{
+			name:  "update from",
+			query: "UPDATE orders o SET tier = $1 FROM customers c WHERE c.id = o.customer_id AND c.country = $2",
+			args:  []interface{}{"gold", "MY"},
+			want:  "SELECT o.* FROM orders o, customers c WHERE c.id = o.customer_id AND c.country = $1",
+			vals:  []interface{}{"MY"},
+		},
+		{
+			name:  "delete using",
+			query: "DELETE FROM tags USING posts WHERE posts.id = tags.post_id AND posts.id = $1",
+			args:  []interface{}{int64(1)},
+			want:  "SELECT tags.* FROM tags, posts WHERE posts.id = tags.post_id AND posts.id = $1",
+			vals:  []interface{}{int64(1)},
+		},
+		{
+			name:  "locked",
+			query: "DELETE FROM users WHERE id = $1",
+			limit: 100,
+			lock:  true,
+			args:  []interface{}{int64(1)},
+			want:  "SELECT * FROM users WHERE id = $1 LIMIT 101 FOR UPDATE",
+			vals:  []interface{}{int64(1)},
+		},
+		{
+			name:  "locked update from",
+			query: "UPDATE orders o SET tier = $1 FROM customers c WHERE c.id = o.customer_id",
+			lock:  true,
+			args:  []interface{}{"gold"},
+			want:  "SELECT o.* FROM orders o, customers c WHERE c.id = o.customer_id FOR UPDATE OF o",
+		},
+	}
+
+	p := &PostgresParser{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := pg_query.Parse(tt.query)
+			require.NoError(t, err)
+
+			relation, from, where := getRelationAndWhere(tree.Stmts[0].Stmt)
+
+			got, vals, err := p.bindQuery(relation, from, where, tt.limit, tt.lock, tt.args)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.vals, vals)
+		})
+	}
+}
+
+func TestMysqlUpdateValues(t *testing.T) {
+	p := &MysqlParser{}
+	r := row{id: "3", key: map[string]string{"id": "3"}}
+
+	got, err := p.marshallFromUpdateQueryArgs(r, "accounts",
+		"UPDATE accounts SET balance = balance - ?, status = 'active', note = ? WHERE id = ?", []interface{}{int64(10), "topped up", int64(3)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"balance":"balance - ?","status":"active","note":"topped up","id":"3"}`, string(got))
+
+	got, err = p.marshallFromUpdateQueryArgs(r, "customers",
+		"UPDATE orders o JOIN customers c ON c.id = o.customer_id SET o.tier = ?, c.tier = ? WHERE o.id = ?", []interface{}{"gold", "silver", int64(3)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"tier":"silver","id":"3"}`, string(got))
+}
+
+func TestUpdateValuesError(t *testing.T) {
+	r := row{id: "3", key: map[string]string{"id": "3"}}
+	event := Event{Action: Update, Table: "accounts"}
+
+	_, err := (&MysqlParser{}).setNewUpdateValues(context.Background(), event, r,
+		"UPDATE accounts SET note = ? WHERE id = ?", nil)
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+
+	_, err = (&PostgresParser{}).setNewUpdateValues(context.Background(), event, r,
+		"UPDATE accounts SET note = $1 WHERE id = $2", nil)
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+func TestPostgresUpdateValues(t *testing.T) {
+	p := &PostgresParser{}
+	r := row{id: "3", key: map[string]string{"id": "3"}}
+
+	got, err := p.marshallFromUpdateQueryArgs(r, "accounts",
+		"UPDATE accounts SET balance = balance - $1, seen = now(), status = 'active', note = $2 WHERE id = $3", []interface{}{int64(10), "topped up", int64(3)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"balance":"balance - $1","seen":"now()","status":"active","note":"topped up","id":"3"}`, string(got))
+}
+
+func TestWithReturning(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		returnAll bool
+		want      string
+		visible   int
+		ok        bool
+	}{
+		{
+			name:    "without returning",
+			query:   "INSERT INTO users (email) VALUES ($1)",
+			want:    "INSERT INTO users (email) VALUES ($1) RETURNING id",
+			visible: 0,
+			ok:      true,
+		},
+		{
+			name:    "returning id",
+			query:   "INSERT INTO users (email) VALUES ($1) RETURNING id",
+			want:    "INSERT INTO users (email) VALUES ($1) RETURNING id",
+			visible: -1,
+			ok:      true,
+		},
+		{
+			name:    "returning star",
+			query:   "INSERT INTO users (email) VALUES ($1) RETURNING *",
+			want:    "INSERT INTO users (email) VALUES ($1) RETURNING *",
+			visible: -1,
+			ok:      true,
+		},
+		{
+			name:    "returning other column",
+			query:   "INSERT INTO users (email) VALUES ($1) RETURNING id AS user_id",
+			want:    "INSERT INTO users (email) VALUES ($1) RETURNING id AS user_id, id",
+			visible: 1,
+			ok:      true,
+		},
+		{
+			name:    "composite key",
+			query:   "INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) RETURNING role_id",
+			want:    "INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) RETURNING role_id, user_id",
+			visible: 1,
+			ok:      true,
+		},
+		{
+			name:  "not an insert",
+			query: "UPDATE users SET email = $1 WHERE id = $2",
+		},
+		{
+			name:      "insert returning all",
+			query:     "INSERT INTO users (email) VALUES ($1) RETURNING id",
+			returnAll: true,
+			want:      "INSERT INTO users (email) VALUES ($1) RETURNING id, *",
+			visible:   1,
+			ok:        true,
+		},
+		{
+			name:      "update returning all",
+			query:     "UPDATE users SET email = $1 WHERE id = $2",
+			returnAll: true,
+			want:      "UPDATE users SET email = $1 WHERE id = $2 RETURNING *",
+			visible:   0,
+			ok:        true,
+		},
+		{
+			name:      "update from returning all",
+			query:     "UPDATE orders o SET tier = $1 FROM customers c WHERE c.id = o.customer_id RETURNING o.id",
+			returnAll: true,
+			want:      "UPDATE orders o SET tier = $1 FROM customers c WHERE c.id = o.customer_id RETURNING o.id, o.*",
+			visible:   1,
+			ok:        true,
+		},
+		{
+			name:      "update from returning star",
+			query:     "UPDATE orders o SET tier = $1 FROM customers c WHERE c.id = o.customer_id RETURNING *",
+			returnAll: true,
+		},
+		{
+			name:      "delete returning all",
+			query:     "DELETE FROM users WHERE id = $1",
+			returnAll: true,
+		},
+		{
+			name:  "exempted",
+			query: "INSERT INTO schema_migrations (version) VALUES ($1)",
+		},
+		{
+			name:  "key not found",
+			query: "INSERT INTO temp_orders (total) VALUES ($1)",
+		},
+		{
+			name:  "no primary key",
+			query: "INSERT INTO page_views (path) VALUES ($1)",
+		},
+		{
+			name:      "no primary key returning all",
+			query:     "INSERT INTO page_views (path) VALUES ($1)",
+			returnAll: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audited := func(tableName string, action Action) bool {
+				return tableName != "schema_migrations"
+			}
+			primaryKey := func(tableName string) ([]string, error) {
+				if tableName == "temp_orders" {
+					return nil, fmt.Errorf("relation %q does not exist", tableName)
+				}
+				if tableName == "user_roles" {
+					return []string{"user_id", "role_id"}, nil
+				}
+				if tableName == "page_views" {
+					return nil, nil
+				}
+				return []string{"id"}, nil
+			}
+			got, ok := withReturning(tt.query, tt.returnAll, audited, primaryKey)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.visible, got.visible)
+			assert.Equal(t, tt.want, got.query)
+		})
+	}
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestReturnedValues(t *testing.T) {
+	rows := &fakeRows{
+		columns: []string{"user_id", "id", "email", "visits"},
+		values: [][]driver.Value{
+			{int64(1), int64(1), []byte("a@example.com"), int64(3)},
+			{int64(2), int64(2), []byte("b@example.com"), nil},
+		},
+	}
+
+	returned, err := bufferRows(rows, []string{"id"}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user_id"}, returned.Columns())
+	assert.Equal(t, []string{"1", "2"}, returnedIDs(returned.result(), nil))
+
+	dest := make([]driver.Value, 1)
+	require.NoError(t, returned.Next(dest))
+	assert.Equal(t, []driver.Value{int64(1)}, dest)
+
+	got, err := returnedValues(returned.result(), nil, []string{"id"})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, "1", got[0].id)
+	assert.JSONEq(t, `{"user_id":"1","id":"1","email":"a@example.com","visits":"3"}`, got[0].oldValues)
+	assert.JSONEq(t, `{"user_id":"2","id":"2","email":"b@example.com","visits":""}`, got[1].oldValues)
+}
+
+// fakeConn runs hook for every statement given to it, in place of the audit
+// hooks, and records what reaches the database.
+type fakeConn struct {
+	hook func(ctx context.Context)
+	log  []string
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return &fakeTx{conn: c}, nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.log = append(c.log, query)
+	if c.hook != nil {
+		c.hook(ctx)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.log = append(c.log, query)
+	if c.hook != nil {
+		c.hook(ctx)
+	}
+	return &fakeRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}}}, nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.log = append(c.log, "PING")
+	return nil
+}
+
+func (c *fakeConn) IsValid() bool { return false }
+
+func (c *fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if _, ok := nv.Value.([]int64); ok {
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (t *fakeTx) Commit() error {
+	t.conn.log = append(t.conn.log, "COMMIT")
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.conn.log = append(t.conn.log, "ROLLBACK")
+	return nil
+}
+
+type recordSink struct {
+	mu      sync.Mutex
+	events  []Event
+	batches int
+}
+
+func (s *recordSink) Write(_ context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	s.batches++
+	return nil
+}
+
+// stuckSink holds up every write until it is released.
+type stuckSink chan struct{}
+
+func (s stuckSink) Write(context.Context, []Event) error {
+	<-s
+	return nil
+}
+
+type failingSink struct{}
+
+func (failingSink) Write(context.Context, []Event) error {
+	return fmt.Errorf("audit table is gone")
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	newConn := func() (*transactionConn, *fakeConn) {
+		fake := &fakeConn{}
+		fake.hook = func(ctx context.Context) {
+			if st, ok := ctx.Value(statementKey{}).(statement); ok && st.conn.tx != nil {
+				require.NoError(t, st.conn.auditor.write(ctx, []Event{{ActorID: 1, Action: Update}}))
+			}
+		}
+		auditor := &Auditor{store: store{sameTransaction: true, sink: &sqlSink{insert: "INSERT INTO audits"}}}
+		return &transactionConn{Conn: fake, auditor: auditor}, fake
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		conn, fake := newConn()
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		assert.Equal(t, []string{"UPDATE users SET name = 'a'", "INSERT INTO audits", "COMMIT"}, fake.log)
+		assert.Nil(t, conn.tx)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		conn, fake := newConn()
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+
+		assert.Equal(t, []string{"UPDATE users SET name = 'a'", "ROLLBACK"}, fake.log)
+		assert.Nil(t, conn.tx)
+	})
+
+	t.Run("outside a transaction", func(t *testing.T) {
+		conn, fake := newConn()
+		_, err := conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"UPDATE users SET name = 'a'"}, fake.log)
+	})
+
+	t.Run("sink", func(t *testing.T) {
+		conn, fake := newConn()
+		sink := &recordSink{}
+		conn.auditor.sink = sink
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+		assert.Empty(t, sink.events)
+		require.NoError(t, tx.Commit())
+
+		assert.Equal(t, []string{"UPDATE users SET name = 'a'", "COMMIT"}, fake.log)
+		assert.Equal(t, []Event{{ActorID: 1, Action: Update}}, sink.events)
+	})
+
+	t.Run("not saved", func(t *testing.T) {
+		conn, _ := newConn()
+		conn.auditor.sink = failingSink{}
+		var reported []Event
+		conn.auditor.onError = func(err error, events []Event) {
+			assert.ErrorIs(t, err, ErrAuditNotSaved)
+			reported = events
+		}
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		assert.Equal(t, []Event{{ActorID: 1, Action: Update}}, reported)
+	})
+
+	t.Run("conflicting options", func(t *testing.T) {
+		auditor := &Auditor{store: store{dbType: SqliteDB, sameTransaction: true, hashChain: true}}
+		assert.ErrorIs(t, auditor.SetDB(), ErrSameTransaction)
+	})
+
+	t.Run("consistent pre-image outside a transaction", func(t *testing.T) {
+		conn, fake := newConn()
+		conn.auditor.consistentPreImage = true
+		hook := fake.hook
+		fake.hook = func(ctx context.Context) {
+			if ctx.Value(statementKey{}) == nil {
+				return
+			}
+			_, ok, err := conn.auditor.readConn(ctx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			hook(ctx)
+		}
+		_, err := conn.ExecContext(ctx, "UPDATE users SET name = 'a'", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"UPDATE users SET name = 'a'", "INSERT INTO audits", "COMMIT"}, fake.log)
+		assert.Nil(t, conn.tx)
+		assert.Nil(t, conn.implicit)
+	})
+
+	t.Run("consistent pre-image of a query", func(t *testing.T) {
+		conn, fake := newConn()
+		conn.auditor.consistentPreImage = true
+		hook := fake.hook
+		fake.hook = func(ctx context.Context) {
+			if ctx.Value(statementKey{}) == nil {
+				return
+			}
+			_, ok, err := conn.auditor.readConn(ctx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			hook(ctx)
+		}
+		rows, err := conn.QueryContext(ctx, "UPDATE users SET name = 'a' RETURNING id", nil)
+		require.NoError(t, err)
+		assert.Nil(t, conn.implicit)
+		// the rows stay locked until they are closed
+		assert.Equal(t, []string{"UPDATE users SET name = 'a' RETURNING id"}, fake.log)
+
+		require.NoError(t, rows.Next(make([]driver.Value, 1)))
+		require.NoError(t, rows.Close())
+		assert.Equal(t, []string{"UPDATE users SET name = 'a' RETURNING id", "INSERT INTO audits", "COMMIT"}, fake.log)
+		assert.Nil(t, conn.tx)
+	})
+}
+
+func TestConnInterfaces(t *testing.T) {
+	ctx := context.Background()
+
+	fake := &fakeConn{}
+	conns := map[string]driver.Conn{
+		"transaction": &transactionConn{Conn: fake},
+		"returning":   &returningConn{Conn: fake},
+	}
+	for name, conn := range conns {
+		t.Run(name, func(t *testing.T) {
+			fake.log = nil
+			require.NoError(t, conn.(driver.Pinger).Ping(ctx))
+			assert.Equal(t, []string{"PING"}, fake.log)
+			assert.False(t, conn.(driver.Validator).IsValid())
+			assert.NoError(t, conn.(driver.NamedValueChecker).CheckNamedValue(&driver.NamedValue{Value: []int64{1}}))
+			assert.Equal(t, driver.ErrSkip, conn.(driver.NamedValueChecker).CheckNamedValue(&driver.NamedValue{Value: "a"}))
+		})
+	}
+
+	// a driver without them is left to database/sql
+	plain := struct{ driver.Conn }{fake}
+	conns = map[string]driver.Conn{
+		"transaction without": &transactionConn{Conn: plain},
+		"returning without":   &returningConn{Conn: plain},
+	}
+	for name, conn := range conns {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, conn.(driver.Pinger).Ping(ctx))
+			assert.True(t, conn.(driver.Validator).IsValid())
+			assert.Equal(t, driver.ErrSkip, conn.(driver.NamedValueChecker).CheckNamedValue(&driver.NamedValue{Value: []int64{1}}))
+		})
+	}
+}
+
+func TestInsertValues(t *testing.T) {
+	ids := []string{"10", "11", "12"}
+	want := []string{
+		`{"name":"go","id":"10"}`,
+		`{"name":"sql","id":"11"}`,
+		`{"name":"audit","id":"12"}`,
+	}
+
+	t.Run("mysql", func(t *testing.T) {
+		p := &MysqlParser{}
+		got, err := p.setNewInsertValues(context.Background(), Event{Action: Insert}, ids,
+			"INSERT INTO tags (name) VALUES (?),(?),('audit')", []interface{}{"go", "sql"})
+		require.NoError(t, err)
+		require.Len(t, got, len(want))
+		for i := range want {
+			assert.Equal(t, ids[i], got[i].TableRowID)
+			assert.JSONEq(t, want[i], got[i].NewValues)
+		}
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		p := &PostgresParser{}
+		got, err := p.setNewInsertValues(context.Background(), Event{Action: Insert}, ids,
+			"INSERT INTO tags (name) VALUES ($1), ($2), ('audit')", []interface{}{"go", "sql"})
+		require.NoError(t, err)
+		require.Len(t, got, len(want))
+		for i := range want {
+			assert.Equal(t, ids[i], got[i].TableRowID)
+			assert.JSONEq(t, want[i], got[i].NewValues)
+		}
+	})
+
+	t.Run("insert select", func(t *testing.T) {
+		for _, tt := range []struct {
+			parser interface {
+				setNewInsertValues(ctx context.Context, event Event, insertIDs []string, query string, args []interface{}) ([]Event, error)
+			}
+			query string
+		}{
+			{&MysqlParser{}, "INSERT INTO tags (name) SELECT name FROM labels"},
+			{&PostgresParser{}, "INSERT INTO tags (name) SELECT name FROM labels"},
+		} {
+			got, err := tt.parser.setNewInsertValues(context.Background(), Event{Action: Insert}, ids, tt.query, nil)
+			require.NoError(t, err)
+			require.Len(t, got, len(ids))
+			for i := range ids {
+				assert.Equal(t, ids[i], got[i].TableRowID)
+				assert.JSONEq(t, `{"id":"`+ids[i]+`"}`, got[i].NewValues)
+			}
+		}
+	})
+
+	t.Run("postgres constants", func(t *testing.T) {
+		p := &PostgresParser{}
+		got, err := p.setNewInsertValues(context.Background(), Event{Action: Insert}, ids[:1],
+			"INSERT INTO products (price, weight, note, active, flags, sold, code) VALUES (12.50, 123456789012345678901, NULL, true, B'101', false, $1::text)", []interface{}{"x1"})
+		require.NoError(t, err)
+		require.Len(t, got, 1)
+		assert.JSONEq(t, `{"price":12.50,"weight":123456789012345678901,"note":null,"active":true,"flags":"b101","sold":false,"code":"x1","id":"10"}`, got[0].NewValues)
+	})
+}
+
+func TestUpsertValues(t *testing.T) {
+	existing := &row{id: "7", key: map[string]string{"id": "7"}, oldValues: `{"id":"7","email":"a@example.com","visits":"1"}`}
+
+	tests := []struct {
+		name   string
+		parser interface {
+			setNewInsertValues(ctx context.Context, event Event, insertIDs []string, query string, args []interface{}) ([]Event, error)
+		}
+		query     string
+		args      []interface{}
+		insertIDs []string
+		upsert    upsert
+		actions   []Action
+		ids       []string
+		values    []string
+	}{
+		{
+			name:      "mysql on duplicate key update",
+			parser:    &MysqlParser{},
+			query:     "INSERT INTO users (email, visits) VALUES (?, 1), (?, 1) ON DUPLICATE KEY UPDATE visits = visits + 1, email = VALUES(email)",
+			args:      []interface{}{"a@example.com", "b@example.com"},
+			insertIDs: []string{"8"},
+			upsert:    upsertUpdate,
+			actions:   []Action{Update, Insert},
+			ids:       []string{"7", "8"},
+			values:    []string{`{"visits":"visits + 1","email":"a@example.com","id":"7"}`, `{"email":"b@example.com","visits":"1","id":"8"}`},
+		},
+		{
+			name:      "mysql insert ignore",
+			parser:    &MysqlParser{},
+			query:     "INSERT IGNORE INTO users (email) VALUES (?), (?)",
+			args:      []interface{}{"a@example.com", "b@example.com"},
+			insertIDs: []string{"8"},
+			upsert:    upsertNothing,
+			actions:   []Action{Insert},
+			ids:       []string{"8"},
+			values:    []string{`{"email":"b@example.com","id":"8"}`},
+		},
+		{
+			name:      "mysql replace",
+			parser:    &MysqlParser{},
+			query:     "REPLACE INTO users (email) VALUES (?), (?)",
+			args:      []interface{}{"a@example.com", "b@example.com"},
+			insertIDs: []string{"8", "9"},
+			upsert:    upsertReplace,
+			actions:   []Action{Update, Insert},
+			ids:       []string{"8", "9"},
+			values:    []string{`{"email":"a@example.com","id":"8"}`, `{"email":"b@example.com","id":"9"}`},
+		},
+		{
+			name:      "postgres on conflict do update",
+			parser:    &PostgresParser{},
+			query:     "INSERT INTO users (email, visits) VALUES ($1, 1), ($2, 1) ON CONFLICT (email) DO UPDATE SET visits = $3, email = excluded.email",
+			args:      []interface{}{"a@example.com", "b@example.com", int64(2)},
+			insertIDs: []string{"7", "8"},
+			upsert:    upsertUpdate,
+			actions:   []Action{Update, Insert},
+			ids:       []string{"7", "8"},
+			values:    []string{`{"visits":2,"email":"a@example.com","id":"7"}`, `{"email":"b@example.com","visits":1,"id":"8"}`},
+		},
+		{
+			name:      "postgres on conflict do nothing",
+			parser:    &PostgresParser{},
+			query:     "INSERT INTO users (email) VALUES ($1), ($2) ON CONFLICT DO NOTHING",
+			args:      []interface{}{"a@example.com", "b@example.com"},
+			insertIDs: []string{"8"},
+			upsert:    upsertNothing,
+			actions:   []Action{Insert},
+			ids:       []string{"8"},
+			values:    []string{`{"email":"b@example.com","id":"8"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := Event{
+				Action: Insert,
+				WhereClause: WhereClause{
+					upsert:    tt.upsert,
+					conflicts: []*row{existing, nil},
+				},
+			}
+
+			got, err := tt.parser.setNewInsertValues(context.Background(), event, tt.insertIDs, tt.query, tt.args)
+			require.NoError(t, err)
+			require.Len(t, got, len(tt.actions))
+			for i := range tt.actions {
+				assert.Equal(t, tt.actions[i], got[i].Action)
+				assert.Equal(t, tt.ids[i], got[i].TableRowID)
+				assert.JSONEq(t, tt.values[i], got[i].NewValues)
+			}
+			if tt.actions[0] == Update {
+				assert.Equal(t, existing.oldValues, got[0].OldValues)
+			}
+		})
+	}
+}
+
+func TestInsertedRows(t *testing.T) {
+	existing := &row{id: "7"}
+	tests := []struct {
+		name         string
+		query        string
+		upsert       upsert
+		rowsAffected int64
+		want         int64
+	}{
+		{name: "insert", query: "INSERT INTO users (email) VALUES (?), (?)", rowsAffected: 2, want: 2},
+		{name: "on duplicate key update", query: "INSERT INTO users (email) VALUES (?), (?) ON DUPLICATE KEY UPDATE visits = visits + 1", upsert: upsertUpdate, rowsAffected: 3, want: 1},
+		{name: "unchanged", query: "INSERT INTO users (email) VALUES (?), (?) ON DUPLICATE KEY UPDATE email = email", upsert: upsertUpdate, rowsAffected: 1, want: 1},
+		{name: "insert ignore", query: "INSERT IGNORE INTO users (email) VALUES (?), (?)", upsert: upsertNothing, rowsAffected: 1, want: 1},
+		{name: "replace", query: "REPLACE INTO users (email) VALUES (?), (?)", upsert: upsertReplace, rowsAffected: 3, want: 2},
+		{name: "insert select", query: "INSERT INTO users (email) SELECT email FROM guests", rowsAffected: 4, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ww := WhereClause{upsert: tt.upsert}
+			if tt.upsert != upsertNone {
+				ww.conflicts = []*row{existing, nil}
+			}
+			assert.Equal(t, tt.want, insertedRows(tt.query, ww, tt.rowsAffected))
+		})
+	}
+}
+
+func TestCompositeKey(t *testing.T) {
+	primaryKey := []string{"user_id", "role_id"}
+
+	id, ok := rowID(map[string]string{"user_id": "1", "role_id": "2"}, primaryKey)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"user_id":"1","role_id":"2"}`, id)
+
+	key, err := keyValues(id, primaryKey)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user_id": "1", "role_id": "2"}, key)
+
+	_, ok = rowID(map[string]string{"user_id": "1"}, primaryKey)
+	assert.False(t, ok)
+
+	p := &MysqlParser{}
+	event := Event{Action: Insert, WhereClause: WhereClause{primaryKey: primaryKey}}
+	got, err := p.setNewInsertValues(context.Background(), event, nil,
+		"INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)", []interface{}{int64(1), int64(2)})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, id, got[0].TableRowID)
+	assert.JSONEq(t, `{"user_id":1,"role_id":2}`, got[0].NewValues)
+}
+
+func TestSetPrimaryKey(t *testing.T) {
+	a := &Auditor{store: store{defaultSchema: "public"}}
+	WithPrimaryKey("user_roles", "user_id", "role_id")(a)
+	WithPrimaryKey("Billing.Invoices", "number")(a)
+
+	for _, tableName := range []string{"user_roles", "User_Roles", "public.user_roles", "audit.user_roles"} {
+		columns, err := a.primaryKeyOf(context.Background(), tableName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"user_id", "role_id"}, columns, tableName)
+	}
+
+	columns, err := a.primaryKeyOf(context.Background(), "billing.invoices")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"number"}, columns)
+
+	columns, err = a.primaryKeyOf(context.Background(), "invoices")
+	require.NoError(t, err)
+	assert.Equal(t, defaultPrimaryKey, columns)
+}
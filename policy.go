@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// Policy says what is audited of the tables it matches. A table is audited by
+// the first policy matching it, and in full when none does.
+type Policy struct {
+	// Table is a table name or path.Match pattern, with or without a schema,
+	// matched regardless of case.
+	Table string
+
+	// Exclude leaves the tables out of the audit.
+	Exclude bool
+	// Actions are the actions audited. Empty audits every action.
+	Actions []Action
+	// IgnoreColumns are left out of the old and new values. An update that
+	// only changes them is not audited.
+	IgnoreColumns []string
+}
+
+// policyFor is the first policy matching a table, if any.
+func policyFor(policies []Policy, tableName, defaultSchema string) *Policy {
+	if tableName == "" {
+		return nil
+	}
+	schema, name := splitTableName(tableName)
+	if schema == "" {
+		schema = defaultSchema
+	}
+
+	for i, policy := range policies {
+		policySchema, policyName := splitTableName(strings.ToLower(policy.Table))
+		if ok, _ := path.Match(policyName, strings.ToLower(name)); !ok {
+			continue
+		}
+		if policySchema == "" {
+			return &policies[i]
+		}
+		if ok, _ := path.Match(policySchema, strings.ToLower(schema)); ok {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// audits tells whether an action on the tables of the policy is audited. An
+// empty action, one not known yet, is audited unless the tables are excluded.
+func (p *Policy) audits(action Action) bool {
+	if p == nil {
+		return true
+	}
+	if p.Exclude {
+		return false
+	}
+	if len(p.Actions) == 0 || action == "" {
+		return true
+	}
+	for _, audited := range p.Actions {
+		if audited == action {
+			return true
+		}
+	}
+	return false
+}
+
+// audited tells whether an action on a table is audited by the policies. It is
+// checked before a statement runs, so that one left out is not read for.
+func (a *Auditor) audited(tableName string, action Action) bool {
+	if len(a.policies) == 0 {
+		return true
+	}
+	return policyFor(a.policies, tableName, a.defaultSchema).audits(action)
+}
+
+// applyPolicies leaves out the events and columns the policies do not audit
+func (a *Auditor) applyPolicies(events []Event, defaultSchema string) []Event {
+	if len(a.policies) == 0 {
+		return events
+	}
+
+	audited := events[:0:0]
+	for _, ev := range events {
+		policy := policyFor(a.policies, ev.Table, defaultSchema)
+		if !policy.audits(ev.Action) {
+			continue
+		}
+		if policy != nil && len(policy.IgnoreColumns) > 0 {
+			var changed bool
+			ev, changed = ignoreColumns(ev, policy.IgnoreColumns)
+			if !changed {
+				continue
+			}
+		}
+		audited = append(audited, ev)
+	}
+	return audited
+}
+
+// ignoreColumns leaves the ignored columns out of the values of an event, and
+// tells whether an update setting any of them still changes another column.
+func ignoreColumns(ev Event, columns []string) (Event, bool) {
+	rules := make([]RedactRule, len(columns))
+	for i, column := range columns {
+		rules[i] = RedactRule{Column: column, Action: RedactDrop}
+	}
+
+	oldFields, err := objectFields(ev.OldValues)
+	if err != nil {
+		return ev, true
+	}
+	newFields, err := objectFields(ev.NewValues)
+	if err != nil {
+		return ev, true
+	}
+	touched := matchAny(rules, newFields)
+	if !touched && !matchAny(rules, oldFields) {
+		return ev, true
+	}
+
+	oldFields = redactFields(oldFields, rules)
+	newFields = redactFields(newFields, rules)
+	ev.OldValues = marshalFields(oldFields, ev.OldValues)
+	ev.NewValues = marshalFields(newFields, ev.NewValues)
+	if ev.Action != Update || !touched {
+		return ev, true
+	}
+
+	old := make(map[string]json.RawMessage, len(oldFields))
+	for _, f := range oldFields {
+		old[f.name] = f.value
+	}
+	for _, f := range newFields {
+		if value, ok := old[f.name]; !ok || !sameValue(value, f.value) {
+			return ev, true
+		}
+	}
+	return ev, false
+}
@@ -4,39 +4,141 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	pg_query "github.com/pganalyze/pg_query_go/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 type PostgresParser struct {
 	db       *sql.DB
-	query    query
 	internal *sql.DB
-	parsed   string
+
+	uniqueKeys keyCache
 }
 
 func (p *PostgresParser) getTableName(query string) (tableName string, err error) {
-	return getSqlTableName(query)
+	stmt, err := parsePostgres(query)
+	if err != nil || stmt == nil {
+		return "", err
+	}
+
+	relation := writtenRelation(stmt)
+	if relation == nil {
+		return "", nil
+	}
+
+	return relationIdentity(relation), nil
+}
+
+// parsePostgres parses a query into its first statement, giving
+// ErrInvalidQuery for a write with a WITH clause, as MySQL does
+func parsePostgres(query string) (*pg_query.Node, error) {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tree.Stmts) == 0 {
+		return nil, nil
+	}
+
+	stmt := tree.Stmts[0].Stmt
+	if writesWith(stmt) {
+		return nil, ErrInvalidQuery
+	}
+
+	return stmt, nil
+}
+
+// writesWith tells whether a statement writes to a table with a WITH clause, or
+// in one.
+func writesWith(stmt *pg_query.Node) bool {
+	var with *pg_query.WithClause
+	switch {
+	case stmt.GetInsertStmt() != nil:
+		with = stmt.GetInsertStmt().GetWithClause()
+	case stmt.GetUpdateStmt() != nil:
+		with = stmt.GetUpdateStmt().GetWithClause()
+	case stmt.GetDeleteStmt() != nil:
+		with = stmt.GetDeleteStmt().GetWithClause()
+	case stmt.GetSelectStmt() != nil:
+		for _, cte := range stmt.GetSelectStmt().GetWithClause().GetCtes() {
+			query := cte.GetCommonTableExpr().GetCtequery()
+			if writtenRelation(query) != nil || writesWith(query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return with != nil
+}
+
+// writtenRelation gives the table a statement writes to, if any.
+func writtenRelation(stmt *pg_query.Node) *pg_query.RangeVar {
+	switch {
+	case stmt.GetInsertStmt() != nil:
+		return stmt.GetInsertStmt().GetRelation()
+	case stmt.GetUpdateStmt() != nil:
+		return stmt.GetUpdateStmt().GetRelation()
+	case stmt.GetDeleteStmt() != nil:
+		return stmt.GetDeleteStmt().GetRelation()
+	default:
+		return nil
+	}
+}
+
+// relationIdentity names a table as `schema.table`, or only `table` when the
+// statement does not qualify it.
+func relationIdentity(relation *pg_query.RangeVar) string {
+	if relation.GetSchemaname() == "" {
+		return relation.GetRelname()
+	}
+	return relation.GetSchemaname() + "." + relation.GetRelname()
+}
+
+// getPostgresAction gives the action of a statement that writes to a table.
+func getPostgresAction(stmt *pg_query.Node) string {
+	switch {
+	case stmt.GetInsertStmt() != nil:
+		return string(Insert)
+	case stmt.GetUpdateStmt() != nil:
+		return string(Update)
+	case stmt.GetDeleteStmt() != nil:
+		return string(Delete)
+	default:
+		return string(Select)
+	}
 }
 
 func (p *PostgresParser) setEvent(ctx context.Context, s store, auditTableName string, event Event, tableName, query string, args []interface{}) (Event, error) {
-	action := getSqlAction(query)
+	stmt, err := parsePostgres(query)
+	if err != nil {
+		return event, err
+	}
+	action := getPostgresAction(stmt)
 
 	ww := WhereClause{}
 
 	ww.tableName = tableName
-	sqlAction := getSqlAction(query)
+	sqlAction := action
 
 	if ww.tableName == auditTableName {
 		return Event{}, nil
 	}
 
+	if action != string(Select) {
+		primaryKey, err := s.primaryKeyOf(ctx, tableName)
+		if err != nil {
+			return event, err
+		}
+		ww.primaryKey = primaryKey
+	}
+
 	oldValues, w, err := p.getOldValues(ctx, s, ww, sqlAction, query, args)
 	if err != nil {
 		return event, err
@@ -51,7 +153,6 @@ func (p *PostgresParser) setEvent(ctx context.Context, s store, auditTableName s
 		fallthrough
 	case string(Delete):
 		event.Action = Action(action)
-		event.TableRowID = w.id
 		event.Table = tableName
 		event.OldValues = oldValues
 		event.WhereClause = w
@@ -70,290 +171,631 @@ func (p *PostgresParser) getOldValues(ctx context.Context, db store, ww WhereCla
 	return string(oldValues), w, nil
 }
 
-type WhereStmt struct {
-	Version int `json:"version"`
-	Stmts   []struct {
-		Stmt struct {
-			DeleteStmt struct {
-				Relation struct {
-					Relname        string `json:"relname"`
-					Inh            bool   `json:"inh"`
-					Relpersistence string `json:"relpersistence"`
-					Location       int    `json:"location"`
-				} `json:"relation"`
-				WhereClause struct {
-					AExpr struct {
-						Kind string `json:"kind"`
-						Name []struct {
-							String struct {
-								Str string `json:"str"`
-							} `json:"String"`
-						} `json:"name"`
-						Lexpr struct {
-							ColumnRef struct {
-								Fields []struct {
-									String struct {
-										Str string `json:"str"`
-									} `json:"String"`
-								} `json:"fields"`
-								Location int `json:"location"`
-							} `json:"ColumnRef"`
-						} `json:"lexpr"`
-						Rexpr struct {
-							ParamRef struct {
-								Number   int `json:"number"`
-								Location int `json:"location"`
-							} `json:"ParamRef"`
-						} `json:"rexpr"`
-						Location int `json:"location"`
-					} `json:"A_Expr"`
-				} `json:"whereClause"`
-			} `json:"DeleteStmt"`
-			UpdateStmt struct {
-				Relation struct {
-					Relname        string `json:"relname"`
-					Inh            bool   `json:"inh"`
-					Relpersistence string `json:"relpersistence"`
-					Location       int    `json:"location"`
-				} `json:"relation"`
-				TargetList []struct {
-					ResTarget struct {
-						Name string `json:"name"`
-						Val  struct {
-							ParamRef struct {
-								Number   int `json:"number"`
-								Location int `json:"location"`
-							} `json:"ParamRef"`
-						} `json:"val"`
-						Location int `json:"location"`
-					} `json:"ResTarget"`
-				} `json:"targetList"`
-				WhereClause struct {
-					AExpr struct {
-						Kind string `json:"kind"`
-						Name []struct {
-							String struct {
-								Str string `json:"str"`
-							} `json:"String"`
-						} `json:"name"`
-						Lexpr struct {
-							ColumnRef struct {
-								Fields []struct {
-									String struct {
-										Str string `json:"str"`
-									} `json:"String"`
-								} `json:"fields"`
-								Location int `json:"location"`
-							} `json:"ColumnRef"`
-						} `json:"lexpr"`
-						Rexpr struct {
-							ParamRef struct {
-								Number   int `json:"number"`
-								Location int `json:"location"`
-							} `json:"ParamRef"`
-						} `json:"rexpr"`
-						Location int `json:"location"`
-					} `json:"A_Expr"`
-				} `json:"whereClause"`
-			} `json:"UpdateStmt"`
-		} `json:"stmt"`
-	} `json:"stmts"`
-}
-
 func (p *PostgresParser) runQuery(ctx context.Context, s store, ww WhereClause, sqlAction, query string, args []interface{}) (out []byte, w WhereClause, err error) {
-	// todo: support 'IN' operator
 	// todo: support key-value store
 
+	var stmt *pg_query.Node
 	switch sqlAction {
 	case string(Update):
-		j, err := pg_query.ParseToJSON(query)
+		fallthrough
+	case string(Delete):
+		stmt, err = parsePostgres(query)
 		if err != nil {
 			return nil, WhereClause{}, err
 		}
-		p.parsed = j
-
-		jsonWhereStmt := WhereStmt{}
-		err = json.Unmarshal([]byte(j), &jsonWhereStmt)
+	case string(Insert):
+		tree, err := pg_query.Parse(query)
 		if err != nil {
 			return nil, WhereClause{}, err
 		}
+		ww, err = p.getConflicts(ctx, s, ww, tree.Stmts[0].Stmt.GetInsertStmt(), args)
+		if err != nil {
+			return nil, WhereClause{}, err
+		}
+		return []byte("{}"), ww, nil
+	default:
+		return []byte("{}"), ww, nil
+	}
 
-		whereClause := jsonWhereStmt.Stmts[0].Stmt.UpdateStmt.WhereClause
-		ww.operator = whereClause.AExpr.Name[0].String.Str
-		ww.col = whereClause.AExpr.Lexpr.ColumnRef.Fields[0].String.Str
-		position := whereClause.AExpr.Rexpr.ParamRef.Number
-		ww.val = args[position-1]
+	relation, from, where := getRelationAndWhere(stmt)
+	ww.query, ww.vals, err = p.bindQuery(relation, from, where, s.rowLimit, s.consistentPreImage, args)
+	if err != nil {
+		return nil, WhereClause{}, err
+	}
 
-	case string(Delete):
-		j, err := pg_query.ParseToJSON(query)
+	ww.rows, err = p.queryMarshal(ctx, s, ww)
+	if err != nil {
+		return nil, WhereClause{}, err
+	}
+	if len(from) > 0 {
+		ww.rows = uniqueRows(ww.rows)
+	}
+	if s.rowLimit > 0 && len(ww.rows) > s.rowLimit {
+		ww.rows = nil
+		ww.truncated = true
+	}
+
+	return []byte("{}"), ww, nil
+}
+
+// getConflicts looks up the existing row each row of an upsert conflicts with
+func (p *PostgresParser) getConflicts(ctx context.Context, s store, ww WhereClause, insert *pg_query.InsertStmt, args []interface{}) (WhereClause, error) {
+	onConflict := insert.GetOnConflictClause()
+	if onConflict == nil {
+		return ww, nil
+	}
+	switch onConflict.Action {
+	case pg_query.OnConflictAction_ONCONFLICT_NOTHING:
+		ww.upsert = upsertNothing
+	case pg_query.OnConflictAction_ONCONFLICT_UPDATE:
+		ww.upsert = upsertUpdate
+	default:
+		return ww, nil
+	}
+
+	var keys [][]string
+	var err error
+	if elems := onConflict.GetInfer().GetIndexElems(); len(elems) > 0 {
+		var key []string
+		for _, elem := range elems {
+			key = append(key, elem.GetIndexElem().GetName())
+		}
+		keys = append(keys, key)
+	} else {
+		keys, err = p.getUniqueKeys(ctx, s, insert.Relation, onConflict.GetInfer().GetConname())
 		if err != nil {
-			return nil, WhereClause{}, err
+			return ww, err
+		}
+	}
+
+	for _, values := range insert.GetSelectStmt().GetSelectStmt().GetValuesLists() {
+		items := values.GetList().GetItems()
+
+		var conditions []*pg_query.Node
+		for _, key := range keys {
+			var matches []*pg_query.Node
+			for _, col := range key {
+				val := insertedNode(insert.Cols, items, col)
+				if val == nil {
+					matches = nil
+					break
+				}
+				column := pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeStrNode(col)}, 0)
+				matches = append(matches, pg_query.MakeAExprNode(pg_query.A_Expr_Kind_AEXPR_OP,
+					[]*pg_query.Node{pg_query.MakeStrNode("=")}, column, val, 0))
+			}
+			switch len(matches) {
+			case 0:
+			case 1:
+				conditions = append(conditions, matches[0])
+			default:
+				conditions = append(conditions, pg_query.MakeBoolExprNode(pg_query.BoolExprType_AND_EXPR, matches, 0))
+			}
+		}
+
+		var where *pg_query.Node
+		switch len(conditions) {
+		case 0:
+			ww.conflicts = append(ww.conflicts, nil)
+			continue
+		case 1:
+			where = conditions[0]
+		default:
+			where = pg_query.MakeBoolExprNode(pg_query.BoolExprType_OR_EXPR, conditions, 0)
 		}
 
-		jsonWhereStmt := WhereStmt{}
-		err = json.Unmarshal([]byte(j), &jsonWhereStmt)
+		lookup := WhereClause{primaryKey: ww.primaryKey}
+		lookup.query, lookup.vals, err = p.bindQuery(insert.Relation, nil, where, 0, s.consistentPreImage, args)
 		if err != nil {
-			return nil, WhereClause{}, err
+			return ww, err
+		}
+		rows, err := p.queryMarshal(ctx, s, lookup)
+		if err != nil {
+			return ww, err
 		}
 
-		whereClause := jsonWhereStmt.Stmts[0].Stmt.DeleteStmt.WhereClause
-		ww.operator = whereClause.AExpr.Name[0].String.Str
-		ww.col = whereClause.AExpr.Lexpr.ColumnRef.Fields[0].String.Str
-		position := whereClause.AExpr.Rexpr.ParamRef.Number
-		ww.val = args[position-1]
-	default:
-		return []byte("{}"), ww, nil
+		var conflict *row
+		if len(rows) > 0 {
+			conflict = &rows[0]
+		}
+		ww.conflicts = append(ww.conflicts, conflict)
 	}
 
-	marshalled, affectedID, err := p.queryMarshal(ctx, s, ww)
+	return ww, nil
+}
+
+// insertedNode gives the value a row of an INSERT has for the column, as long
+// as it is a parameter or a constant.
+func insertedNode(cols []*pg_query.Node, items []*pg_query.Node, col string) *pg_query.Node {
+	for i, c := range cols {
+		if c.GetResTarget().GetName() != col || i >= len(items) {
+			continue
+		}
+		if items[i].GetParamRef() == nil && items[i].GetAConst() == nil {
+			return nil
+		}
+		return proto.Clone(items[i]).(*pg_query.Node)
+	}
+	return nil
+}
+
+// getUniqueKeys reads the columns of the primary key and unique indexes of a
+// table
+func (p *PostgresParser) getUniqueKeys(ctx context.Context, s store, relation *pg_query.RangeVar, constraint string) ([][]string, error) {
+	table := pq.QuoteIdentifier(relation.GetRelname())
+	if relation.GetSchemaname() != "" {
+		table = pq.QuoteIdentifier(relation.GetSchemaname()) + "." + table
+	}
+	if keys, ok := p.uniqueKeys.get(table + "/" + constraint); ok {
+		return keys, nil
+	}
+
+	rows, err := s.sql.QueryContext(ctx, `SELECT i.relname, a.attname
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN LATERAL unnest(x.indkey) WITH ORDINALITY AS k(attnum, n) ON true
+		JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+		WHERE x.indrelid = $1::regclass AND x.indisunique AND x.indpred IS NULL AND x.indexprs IS NULL
+		ORDER BY i.relname, k.n`, table)
 	if err != nil {
-		return nil, WhereClause{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]string
+	var last string
+	for rows.Next() {
+		var index, column string
+		if err = rows.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		if constraint != "" && index != constraint {
+			continue
+		}
+		if index != last || len(keys) == 0 {
+			keys = append(keys, nil)
+			last = index
+		}
+		keys[len(keys)-1] = append(keys[len(keys)-1], column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p.uniqueKeys.set(table+"/"+constraint, keys)
+
+	return keys, nil
+}
+
+// readRows selects the rows of a table with the given ids.
+func (p *PostgresParser) readRows(ctx context.Context, s store, tableName string, primaryKey []string, ids []string) ([]row, error) {
+	schema, name := splitTableName(tableName)
+	relation := pg_query.MakeFullRangeVar(schema, name, "", 0)
+
+	var args []interface{}
+	arg := func(val string) *pg_query.Node {
+		args = append(args, val)
+		return pg_query.MakeParamRefNode(int32(len(args)), 0)
+	}
+	column := func(col string) *pg_query.Node {
+		return pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeStrNode(col)}, 0)
 	}
-	ww.id = affectedID
+
+	var where *pg_query.Node
+	if len(primaryKey) == 1 {
+		in := make([]*pg_query.Node, 0, len(ids))
+		for _, id := range ids {
+			in = append(in, arg(id))
+		}
+		where = pg_query.MakeAExprNode(pg_query.A_Expr_Kind_AEXPR_IN,
+			[]*pg_query.Node{pg_query.MakeStrNode("=")}, column(primaryKey[0]), pg_query.MakeListNode(in), 0)
+	} else {
+		var conditions []*pg_query.Node
+		for _, id := range ids {
+			key, err := keyValues(id, primaryKey)
+			if err != nil {
+				return nil, err
+			}
+
+			var matches []*pg_query.Node
+			for _, col := range primaryKey {
+				matches = append(matches, pg_query.MakeAExprNode(pg_query.A_Expr_Kind_AEXPR_OP,
+					[]*pg_query.Node{pg_query.MakeStrNode("=")}, column(col), arg(key[col]), 0))
+			}
+			conditions = append(conditions, pg_query.MakeBoolExprNode(pg_query.BoolExprType_AND_EXPR, matches, 0))
+		}
+		where = pg_query.MakeBoolExprNode(pg_query.BoolExprType_OR_EXPR, conditions, 0)
+	}
+
+	var err error
+	ww := WhereClause{primaryKey: primaryKey}
+	ww.query, ww.vals, err = p.bindQuery(relation, nil, where, 0, false, args)
 	if err != nil {
-		return nil, ww, err
+		return nil, err
 	}
 
-	return marshalled, ww, nil
+	return p.queryMarshal(ctx, s, ww)
 }
 
-func (p *PostgresParser) queryMarshal(ctx context.Context, s store, ww WhereClause) ([]byte, uint64, error) {
-	var affectedID uint64 // todo: id can be a string
+// getPrimaryKey reads the primary key columns of a table from the database.
+func (p *PostgresParser) getPrimaryKey(ctx context.Context, s store, tableName string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(tableName, ".") {
+		parts = append(parts, pq.QuoteIdentifier(strings.Trim(part, `"`)))
+	}
 
-	query := fmt.Sprintf(p.query.selectStmt, ww.tableName, ww.col, ww.operator)
-	rows, err := s.sql.QueryContext(ctx, query, ww.val)
+	rows, err := s.internal.QueryContext(ctx, `SELECT a.attname
+		FROM pg_index x
+		JOIN LATERAL unnest(x.indkey) WITH ORDINALITY AS k(attnum, n) ON true
+		JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+		WHERE x.indrelid = $1::regclass AND x.indisprimary
+		ORDER BY k.n`, strings.Join(parts, "."))
 	if err != nil {
-		return nil, affectedID, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// getRelationAndWhere gives the table and WHERE clause of an UPDATE or DELETE
+func getRelationAndWhere(stmt *pg_query.Node) (*pg_query.RangeVar, []*pg_query.Node, *pg_query.Node) {
+	switch {
+	case stmt.GetUpdateStmt() != nil:
+		upd := stmt.GetUpdateStmt()
+		return upd.GetRelation(), upd.GetFromClause(), upd.GetWhereClause()
+	case stmt.GetDeleteStmt() != nil:
+		del := stmt.GetDeleteStmt()
+		return del.GetRelation(), del.GetUsingClause(), del.GetWhereClause()
+	default:
+		return nil, nil, nil
+	}
+}
+
+// bindQuery builds a SELECT of the rows an UPDATE or DELETE writes to
+func (p *PostgresParser) bindQuery(relation *pg_query.RangeVar, from []*pg_query.Node, where *pg_query.Node, rowLimit int, lock bool, args []interface{}) (string, []interface{}, error) {
+	var vals []interface{}
+	var err error
+
+	fromClause := []*pg_query.Node{{Node: &pg_query.Node_RangeVar{RangeVar: relation}}}
+	for _, node := range from {
+		fromClause = append(fromClause, proto.Clone(node).(*pg_query.Node))
+	}
+	if where != nil {
+		where = proto.Clone(where).(*pg_query.Node)
+	}
+
+	renumbered := make(map[int32]int32)
+	renumber := func(ref *pg_query.ParamRef) {
+		if ref.Number < 1 || int(ref.Number) > len(args) {
+			err = ErrInvalidQuery
+			return
+		}
+		number, ok := renumbered[ref.Number]
+		if !ok {
+			vals = append(vals, args[ref.Number-1])
+			number = int32(len(vals))
+			renumbered[ref.Number] = number
+		}
+		ref.Number = number
+	}
+	for _, node := range fromClause[1:] {
+		walkParamRefs(node.ProtoReflect(), renumber)
+	}
+	if where != nil {
+		walkParamRefs(where.ProtoReflect(), renumber)
 	}
-	cols, err := rows.Columns()
 	if err != nil {
-		return nil, affectedID, err
+		return "", nil, err
 	}
-	vals := make([]interface{}, len(cols))
-	toString := make(map[string]string, len(cols))
-	for i := range cols {
-		vals[i] = new(sql.RawBytes)
+
+	fields := []*pg_query.Node{pg_query.MakeAStarNode()}
+	if len(from) > 0 {
+		fields = append([]*pg_query.Node{pg_query.MakeStrNode(relationRef(relation))}, fields...)
 	}
-	for rows.Next() {
-		_ = rows.Scan(vals...)
+	star := pg_query.MakeColumnRefNode(fields, 0)
+	sel := &pg_query.SelectStmt{
+		TargetList:  []*pg_query.Node{pg_query.MakeResTargetNodeWithVal(star, 0)},
+		FromClause:  fromClause,
+		WhereClause: where,
+		LimitOption: pg_query.LimitOption_LIMIT_OPTION_DEFAULT,
+		Op:          pg_query.SetOperation_SETOP_NONE,
+	}
+	if rowLimit > 0 {
+		sel.LimitCount = pg_query.MakeAConstIntNode(int64(rowLimit+1), 0)
+		sel.LimitOption = pg_query.LimitOption_LIMIT_OPTION_COUNT
 	}
+	if lock {
+		locking := &pg_query.LockingClause{
+			Strength:   pg_query.LockClauseStrength_LCS_FORUPDATE,
+			WaitPolicy: pg_query.LockWaitPolicy_LockWaitBlock,
+		}
+		if len(from) > 0 {
+			locking.LockedRels = []*pg_query.Node{{Node: &pg_query.Node_RangeVar{
+				RangeVar: pg_query.MakeSimpleRangeVar(relationRef(relation), 0),
+			}}}
+		}
+		sel.LockingClause = []*pg_query.Node{{Node: &pg_query.Node_LockingClause{LockingClause: locking}}}
+	}
+	query, err := pg_query.Deparse(&pg_query.ParseResult{
+		Stmts: []*pg_query.RawStmt{{Stmt: &pg_query.Node{Node: &pg_query.Node_SelectStmt{SelectStmt: sel}}}},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return query, vals, nil
+}
 
-	for i, val := range vals {
-		content := reflect.ValueOf(val).Interface().(*sql.RawBytes)
-		toString[cols[i]] = string(*content)
-		if cols[i] == "id" { // todo: customise table id name
-			affectedID, err = strconv.ParseUint(toString[cols[i]], 10, 64)
+// relationRef is the name a statement refers to the relation by, which is its
+// alias if it has one.
+func relationRef(relation *pg_query.RangeVar) string {
+	if relation.GetAlias().GetAliasname() != "" {
+		return relation.GetAlias().GetAliasname()
+	}
+	return relation.GetRelname()
+}
+
+// walkParamRefs calls fn for every `$n` parameter found in the node.
+func walkParamRefs(m protoreflect.Message, fn func(ref *pg_query.ParamRef)) {
+	if ref, ok := m.Interface().(*pg_query.ParamRef); ok {
+		fn(ref)
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				walkParamRefs(list.Get(i).Message(), fn)
+			}
+		case fd.Message() != nil && !fd.IsMap():
+			walkParamRefs(v.Message(), fn)
+		}
+		return true
+	})
+}
+
+// getParamValues resolves an expression into values, looking up `$n`
+// parameters from the query args.
+func (p *PostgresParser) getParamValues(node *pg_query.Node, args []interface{}) ([]interface{}, error) {
+	switch {
+	case node.GetList() != nil:
+		var vals []interface{}
+		for _, item := range node.GetList().Items {
+			val, err := p.getParamValues(item, args)
 			if err != nil {
-				return nil, 0, err
+				return nil, err
+			}
+			vals = append(vals, val...)
+		}
+		return vals, nil
+	case node.GetParamRef() != nil:
+		position := int(node.GetParamRef().Number)
+		if position < 1 || position > len(args) {
+			return nil, ErrInvalidQuery
+		}
+		return []interface{}{args[position-1]}, nil
+	case node.GetAConst() != nil:
+		val := node.GetAConst().Val
+		switch {
+		case val.GetInteger() != nil:
+			return []interface{}{val.GetInteger().Ival}, nil
+		case val.GetFloat() != nil:
+			// kept as written, as numerics may not fit a float64
+			str := val.GetFloat().GetStr()
+			if json.Valid([]byte(str)) {
+				return []interface{}{json.Number(str)}, nil
 			}
+			return []interface{}{str}, nil
+		case val.GetNull() != nil:
+			return []interface{}{nil}, nil
+		case val.GetBitString() != nil:
+			return []interface{}{val.GetBitString().GetStr()}, nil
+		case val.GetString_() != nil:
+			return []interface{}{val.GetString_().GetStr()}, nil
+		default:
+			return nil, ErrInvalidQuery
+		}
+	case node.GetTypeCast() != nil:
+		// true and false are parsed as the strings 't' and 'f' cast to bool
+		cast := node.GetTypeCast()
+		vals, err := p.getParamValues(cast.GetArg(), args)
+		if err != nil || len(vals) != 1 {
+			return vals, err
 		}
+		names := cast.GetTypeName().GetNames()
+		if str, ok := vals[0].(string); ok && len(names) > 0 && names[len(names)-1].GetString_().GetStr() == "bool" {
+			if b, err := strconv.ParseBool(str); err == nil {
+				return []interface{}{b}, nil
+			}
+		}
+		return vals, nil
+	default:
+		return nil, ErrInvalidQuery
+	}
+}
+
+// isConstant tells whether a value is a param or a constant, which
+// getParamValues resolves.
+func isConstant(node *pg_query.Node) bool {
+	switch {
+	case node.GetParamRef() != nil, node.GetAConst() != nil:
+		return true
+	case node.GetTypeCast() != nil:
+		return isConstant(node.GetTypeCast().GetArg())
+	default:
+		return false
 	}
+}
 
-	marshaled, err := json.Marshal(toString)
+// deparseExpr writes an expression back as SQL.
+func deparseExpr(node *pg_query.Node) (string, error) {
+	sel := &pg_query.SelectStmt{TargetList: []*pg_query.Node{pg_query.MakeResTargetNodeWithVal(node, 0)}}
+	query, err := pg_query.Deparse(&pg_query.ParseResult{
+		Stmts: []*pg_query.RawStmt{{Stmt: &pg_query.Node{Node: &pg_query.Node_SelectStmt{SelectStmt: sel}}}},
+	})
 	if err != nil {
-		return nil, affectedID, err
+		return "", err
 	}
 
-	return marshaled, affectedID, nil
+	return strings.TrimPrefix(query, "SELECT "), nil
 }
 
-func (p *PostgresParser) Save(ctx context.Context, query string, args []interface{}, lastInsertID int64, event Event) error {
-	var e error
+func (p *PostgresParser) queryMarshal(ctx context.Context, s store, ww WhereClause) ([]row, error) {
+	conn, ok, err := s.readConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return conn.queryRows(ctx, ww.query, ww.vals, ww.primaryKey)
+	}
 
-	query = strings.ToLower(query)
+	rows, err := s.sql.QueryContext(ctx, ww.query, ww.vals...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRows(rows, ww.primaryKey)
+}
+
+// newEvents builds the events a statement is audited as, one for every row it
+// wrote to.
+func (p *PostgresParser) newEvents(ctx context.Context, query string, args []interface{}, insertIDs []string, event Event) ([]Event, error) {
+	if event.WhereClause.truncated {
+		event.OldValues = "{}"
+		event.NewValues = summaryValues(query, event.WhereClause.rowsAffected)
+		event.CreatedAt = time.Now()
+		return []Event{event}, nil
+	}
 
+	var events []Event
 	switch event.Action {
 	case Insert:
-		event = p.setNewInsertValues(ctx, event, lastInsertID, query, args)
-
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		inserted, err := p.setNewInsertValues(ctx, event, insertIDs, query, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range inserted {
+			events = append(events, withPostImage(ev))
+		}
 	case Update:
-		event = p.setNewUpdateValues(ctx, event, query, args)
-
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		for _, w := range event.WhereClause.targets() {
+			target := event
+			target.Table = w.tableName
+			for _, r := range w.rows {
+				ev, err := p.setNewUpdateValues(ctx, target, r, query, args)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, withPostImage(ev))
+			}
+		}
 	case Delete:
-		event.NewValues = "{}"
-		event.CreatedAt = time.Now()
-		_, err := p.internal.ExecContext(ctx, p.query.insert,
-			event.ActorID,
-			event.TableRowID,
-			event.Table,
-			event.Action,
-			event.OldValues,
-			event.NewValues,
-			event.HTTPMethod,
-			event.URL,
-			event.IPAddress,
-			event.UserAgent,
-			event.CreatedAt,
-		)
-		e = err
+		for _, w := range event.WhereClause.targets() {
+			target := event
+			target.Table = w.tableName
+			for _, r := range w.rows {
+				ev := target
+				ev.TableRowID = r.id
+				ev.OldValues = r.oldValues
+				ev.NewValues = "{}"
+				ev.CreatedAt = time.Now()
+				events = append(events, ev)
+			}
+		}
 	default:
-		e = ErrInvalidConnection
+		return nil, ErrInvalidConnection
 	}
-	return e
+
+	return events, nil
 }
 
-func (p *PostgresParser) setNewInsertValues(ctx context.Context, event Event, lastInsertID int64, query string, args []interface{}) Event {
-	marshalled, err := p.marshalInsertQuery(query, lastInsertID, args)
+// setNewInsertValues builds an event for every row of an INSERT
+func (p *PostgresParser) setNewInsertValues(ctx context.Context, event Event, insertIDs []string, query string, args []interface{}) ([]Event, error) {
+	inserted, updated, err := p.insertValues(query, insertIDs, args)
 	if err != nil {
-		return Event{}
+		return nil, err
 	}
-	event.TableRowID = uint64(lastInsertID)
-	event.NewValues = string(marshalled)
-	event.CreatedAt = time.Now()
 
-	return event
+	return insertEvents(event, inserted, updated, insertIDs, true)
 }
 
-func (p *PostgresParser) marshalInsertQuery(query string, lastInsertID int64, args []interface{}) ([]byte, error) {
-	toString := make(map[string]interface{}, len(args)+1)
-
-	columnNames := getColumnNamesFromInsert(query)
-	for i, col := range columnNames {
-		toString[col] = args[i]
+// insertValues gives the values of every row of an INSERT, and of its
+// `ON CONFLICT DO UPDATE`
+func (p *PostgresParser) insertValues(query string, insertIDs []string, args []interface{}) (inserted, updated []map[string]interface{}, err error) {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	insert := tree.Stmts[0].Stmt.GetInsertStmt()
+	if insert == nil {
+		return nil, nil, ErrInvalidQuery
 	}
 
-	toString["id"] = lastInsertID
+	// rows of an `INSERT ... SELECT` are not known, so only their ids are kept
+	valuesLists := insert.GetSelectStmt().GetSelectStmt().GetValuesLists()
+	count := len(valuesLists)
+	if count == 0 {
+		count = len(insertIDs)
+	}
 
-	marshalled, err := json.Marshal(toString)
-	if err != nil {
-		return nil, err
+	for i := 0; i < count; i++ {
+		toString := make(map[string]interface{}, len(insert.Cols)+1)
+		if i < len(valuesLists) {
+			items := valuesLists[i].GetList().GetItems()
+			for j, col := range insert.Cols {
+				if j >= len(items) {
+					break
+				}
+				vals, err := p.getParamValues(items[j], args)
+				if err != nil || len(vals) == 0 {
+					continue
+				}
+				toString[col.GetResTarget().GetName()] = vals[0]
+			}
+		}
+		inserted = append(inserted, toString)
+
+		targetList := insert.GetOnConflictClause().GetTargetList()
+		toUpdate := make(map[string]interface{}, len(targetList))
+		for _, node := range targetList {
+			target := node.GetResTarget()
+			fields := target.GetVal().GetColumnRef().GetFields()
+			if len(fields) == 2 && fields[0].GetString_().GetStr() == "excluded" {
+				toUpdate[target.Name] = toString[fields[1].GetString_().GetStr()]
+				continue
+			}
+			vals, err := p.getParamValues(target.Val, args)
+			if err != nil || len(vals) == 0 {
+				continue
+			}
+			toUpdate[target.Name] = vals[0]
+		}
+		updated = append(updated, toUpdate)
 	}
 
-	return marshalled, nil
+	return inserted, updated, nil
 }
 
-func (p *PostgresParser) setNewUpdateValues(ctx context.Context, event Event, query string, args []interface{}) Event {
-	newValues, err := p.marshallFromUpdateQueryArgs(query, args)
+func (p *PostgresParser) setNewUpdateValues(ctx context.Context, event Event, r row, query string, args []interface{}) (Event, error) {
+	event.TableRowID = r.id
+	event.OldValues = r.oldValues
+
+	newValues, err := p.marshallFromUpdateQueryArgs(r, event.Table, query, args)
 	if err != nil {
-		return event
+		return Event{}, err
 	}
 	event.NewValues = string(newValues)
 	event.CreatedAt = time.Now()
@@ -363,24 +805,40 @@ func (p *PostgresParser) setNewUpdateValues(ctx context.Context, event Event, qu
 		event.ActorID = val
 	}
 
-	return event
+	return event, nil
 }
 
-func (p *PostgresParser) marshallFromUpdateQueryArgs(query string, args []interface{}) ([]byte, error) {
-	jsonWhereStmt := WhereStmt{}
-	err := json.Unmarshal([]byte(p.parsed), &jsonWhereStmt)
+func (p *PostgresParser) marshallFromUpdateQueryArgs(r row, tableName, query string, args []interface{}) ([]byte, error) {
+	stmt, err := parsePostgres(query)
 	if err != nil {
 		return nil, err
 	}
-
-	targetList := jsonWhereStmt.Stmts[0].Stmt.UpdateStmt.TargetList
-	toString := make(map[string]string, len(targetList)+1)
+	targetList := stmt.GetUpdateStmt().GetTargetList()
+	toString := make(map[string]interface{}, len(targetList)+1)
 
 	for _, col := range targetList {
-		colName := col.ResTarget.Name
-		pos := col.ResTarget.Val.ParamRef.Number
+		target := col.GetResTarget()
+		if !isConstant(target.Val) {
+			// expressions such as `now()` or `balance - $1` are kept as written
+			written, err := deparseExpr(target.Val)
+			if err != nil {
+				return nil, err
+			}
+			toString[target.Name] = written
+			continue
+		}
 
-		toString[colName] = args[pos-1].(string)
+		vals, err := p.getParamValues(target.Val, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			continue
+		}
+		toString[target.Name] = vals[0]
+	}
+	for col, val := range r.key {
+		toString[col] = val
 	}
 
 	marshalled, err := json.Marshal(toString)
@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueClosed = fmt.Errorf("audit queue is closed")
+	ErrNoSpillSink = fmt.Errorf("audit queue spills to no sink")
+)
+
+// QueuePolicy is what is done with events given to a full queue.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits for the queue to have room, holding up the statement.
+	QueueBlock QueuePolicy = iota
+	// QueueDrop leaves the events out, counting them in Auditor.Dropped.
+	QueueDrop
+	// QueueSpill writes the events to the spill sink straight away, which is to
+	// be set.
+	QueueSpill
+)
+
+// QueueConfig sets up the queue events are written through.
+type QueueConfig struct {
+	// Size is the number of events the queue holds. Defaults to 10000.
+	Size int
+	// BatchSize is the most events written together. Defaults to 100.
+	BatchSize int
+	// FlushInterval is the longest an event waits for its batch to fill up.
+	// Defaults to one second.
+	FlushInterval time.Duration
+	// Policy is what is done with events given to a full queue.
+	Policy QueuePolicy
+	// Spill takes the events QueueSpill does not queue, and the batches that
+	// could not be written.
+	Spill Sink
+	// MaxRetries is the retries of a failed batch before it is spilled.
+	// Defaults to 3.
+	MaxRetries int
+	// OnError is called with a batch that could not be written either way.
+	// Defaults to logging the error.
+	OnError func(err error, events []Event)
+}
+
+const (
+	defaultQueueSize     = 10000
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueRetries  = 3
+	queueRetryWait       = 100 * time.Millisecond
+)
+
+// queue writes events to the sink in batches, in the background.
+type queue struct {
+	sink   Sink
+	config QueueConfig
+
+	events  chan Event
+	done    chan struct{}
+	dropped uint64
+
+	// mu guards closed, and writers are those that got past it, which are
+	// waited for before events is closed.
+	mu      sync.RWMutex
+	closed  bool
+	writers sync.WaitGroup
+}
+
+func newQueue(sink Sink, config QueueConfig) (*queue, error) {
+	if config.Policy == QueueSpill && config.Spill == nil {
+		return nil, ErrNoSpillSink
+	}
+	if config.Size <= 0 {
+		config.Size = defaultQueueSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = defaultQueueRetries
+	}
+	if config.OnError == nil {
+		config.OnError = func(err error, events []Event) {
+			log.Printf("audit: %d events not saved: %v", len(events), err)
+		}
+	}
+
+	q := &queue{
+		sink:   sink,
+		config: config,
+		events: make(chan Event, config.Size),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+
+	return q, nil
+}
+
+// Write queues the events, which are saved later on.
+func (q *queue) Write(ctx context.Context, events []Event) error {
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return ErrQueueClosed
+	}
+	// the lock is not held while waiting for room
+	q.writers.Add(1)
+	q.mu.RUnlock()
+	defer q.writers.Done()
+
+	var spill []Event
+	for _, ev := range events {
+		select {
+		case q.events <- ev:
+			continue
+		default:
+		}
+
+		switch q.config.Policy {
+		case QueueBlock:
+			select {
+			case q.events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case QueueDrop:
+			atomic.AddUint64(&q.dropped, 1)
+		case QueueSpill:
+			spill = append(spill, ev)
+		}
+	}
+	if len(spill) > 0 {
+		return q.config.Spill.Write(ctx, spill)
+	}
+
+	return nil
+}
+
+func (q *queue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, q.config.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := q.write(batch); err != nil {
+			q.config.OnError(err, batch)
+		}
+		batch = make([]Event, 0, q.config.BatchSize)
+	}
+
+	for {
+		select {
+		case ev, ok := <-q.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= q.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write writes a batch to the sink, retrying failures, and then to the spill
+// sink when one is set.
+func (q *queue) write(batch []Event) error {
+	ctx := context.Background()
+	err := q.sink.Write(ctx, batch)
+	wait := queueRetryWait
+	for attempt := 0; err != nil && attempt < q.config.MaxRetries; attempt++ {
+		time.Sleep(wait)
+		wait *= 2
+		err = q.sink.Write(ctx, batch)
+	}
+	if err == nil || q.config.Spill == nil {
+		return err
+	}
+
+	if e := q.config.Spill.Write(ctx, batch); e != nil {
+		return fmt.Errorf("%v, and not spilled: %w", err, e)
+	}
+	return nil
+}
+
+// Close stops taking events and waits for those queued to be written.
+func (q *queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		go func() {
+			q.writers.Wait()
+			close(q.events)
+		}()
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,294 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrRedactSalt is given by NewAudit for a RedactHash rule without a salt.
+var ErrRedactSalt = fmt.Errorf("hashing needs a salt")
+
+// RedactAction is what a redaction rule does to the value of a column.
+type RedactAction int
+
+const (
+	// RedactDrop leaves the column out.
+	RedactDrop RedactAction = iota
+	// RedactMask replaces the value with RedactRule.Mask.
+	RedactMask
+	// RedactLast keeps only the last RedactRule.Keep characters of the value.
+	RedactLast
+	// RedactHash replaces the value with its HMAC-SHA256 under RedactRule.Salt,
+	// so that equal values can still be told apart from different ones.
+	RedactHash
+)
+
+// redactedKey lists the redacted columns an event changed, as their values no
+// longer tell.
+const redactedKey = "_redacted"
+
+// defaultMask is the value RedactMask replaces with by default.
+const defaultMask = "[REDACTED]"
+
+// RedactRule hides the values of the columns it matches before an event is
+// saved.
+type RedactRule struct {
+	// Table is the table the rule applies to, matched as for table exceptions.
+	// Empty applies to every table.
+	Table string
+	// Column is the name of the column, or a pattern as matched by path.Match,
+	// such as `*_token`. Both are matched regardless of case.
+	Column string
+
+	Action RedactAction
+	// Mask is the value RedactMask replaces with. Defaults to `[REDACTED]`.
+	Mask string
+	// Keep is the number of characters RedactLast keeps.
+	Keep int
+	// Salt keys the hash of RedactHash, and is required by it.
+	Salt []byte
+}
+
+// field is a column of the JSON object of old or new values, keeping its place
+// in the object.
+type field struct {
+	name  string
+	value json.RawMessage
+}
+
+// redact applies the redaction rules to the events, when set up by
+// WithRedaction.
+func (s store) redact(events []Event) {
+	if len(s.redaction) == 0 {
+		return
+	}
+
+	for i, ev := range events {
+		var rules []RedactRule
+		for _, rule := range s.redaction {
+			if rule.Table == "" || (ev.Table != "" && isExempted([]string{rule.Table}, ev.Table, s.defaultSchema)) {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		events[i] = redactEvent(ev, rules)
+	}
+}
+
+// redactEvent redacts the values of an event, and replaces those it cannot read
+func redactEvent(ev Event, rules []RedactRule) Event {
+	replaced := false
+	oldFields, err := objectFields(ev.OldValues)
+	if err != nil {
+		oldFields, replaced = unreadableFields(), true
+	}
+	newFields, err := objectFields(ev.NewValues)
+	if err != nil {
+		newFields, replaced = unreadableFields(), true
+	}
+	if ev.WhereClause.truncated {
+		for i, f := range newFields {
+			if f.name == "query" {
+				newFields[i].value, _ = json.Marshal(defaultMask)
+				replaced = true
+			}
+		}
+	}
+	if !replaced && !matchAny(rules, oldFields) && !matchAny(rules, newFields) {
+		return ev
+	}
+
+	var changed []string
+	if ev.Action == Delete {
+		for _, f := range oldFields {
+			if matchRule(rules, f.name) != nil {
+				changed = append(changed, f.name)
+			}
+		}
+	} else {
+		old := make(map[string]json.RawMessage, len(oldFields))
+		for _, f := range oldFields {
+			old[f.name] = f.value
+		}
+		for _, f := range newFields {
+			if matchRule(rules, f.name) == nil {
+				continue
+			}
+			if value, ok := old[f.name]; !ok || !sameValue(value, f.value) {
+				changed = append(changed, f.name)
+			}
+		}
+	}
+
+	oldFields = redactFields(oldFields, rules)
+	newFields = redactFields(newFields, rules)
+	if len(changed) > 0 {
+		marshalled, _ := json.Marshal(changed)
+		if ev.Action == Delete {
+			oldFields = append(oldFields, field{name: redactedKey, value: marshalled})
+		} else {
+			newFields = append(newFields, field{name: redactedKey, value: marshalled})
+		}
+	}
+
+	ev.OldValues = marshalFields(oldFields, ev.OldValues)
+	ev.NewValues = marshalFields(newFields, ev.NewValues)
+	return ev
+}
+
+// sameValue tells whether two values are the same once written as text, as old
+// values are read as text while new values keep the type of their arg.
+func sameValue(a, b json.RawMessage) bool {
+	return bytes.Equal(a, b) || valueText(a) == valueText(b)
+}
+
+// valueText writes a JSON value as the text a column read from the database
+// has.
+func valueText(raw json.RawMessage) string {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return string(raw)
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number, bool:
+		return fmt.Sprint(v)
+	default:
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw); err != nil {
+			return string(raw)
+		}
+		return compact.String()
+	}
+}
+
+// unreadableFields stand in for values that could not be redacted.
+func unreadableFields() []field {
+	value, _ := json.Marshal(defaultMask)
+	return []field{{name: redactedKey, value: value}}
+}
+
+// matchRule is the first rule matching a column, if any.
+func matchRule(rules []RedactRule, column string) *RedactRule {
+	for i, rule := range rules {
+		if ok, _ := path.Match(strings.ToLower(rule.Column), strings.ToLower(column)); ok {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func matchAny(rules []RedactRule, fields []field) bool {
+	for _, f := range fields {
+		if matchRule(rules, f.name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func redactFields(fields []field, rules []RedactRule) []field {
+	redacted := fields[:0:0]
+	for _, f := range fields {
+		rule := matchRule(rules, f.name)
+		if rule == nil {
+			redacted = append(redacted, f)
+			continue
+		}
+		if rule.Action == RedactDrop {
+			continue
+		}
+		// a null value tells nothing to hide
+		if string(f.value) != "null" {
+			f.value, _ = json.Marshal(redactValue(*rule, f.value))
+		}
+		redacted = append(redacted, f)
+	}
+	return redacted
+}
+
+func redactValue(rule RedactRule, value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		s = string(value)
+	}
+
+	switch rule.Action {
+	case RedactLast:
+		runes := []rune(s)
+		if rule.Keep < len(runes) {
+			runes = runes[len(runes)-rule.Keep:]
+		}
+		return string(runes)
+	case RedactHash:
+		mac := hmac.New(sha256.New, rule.Salt)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	default:
+		if rule.Mask == "" {
+			return defaultMask
+		}
+		return rule.Mask
+	}
+}
+
+// objectFields reads the columns of a JSON object in order. Values that are
+// not an object, such as an empty string, have no columns.
+func objectFields(values string) ([]field, error) {
+	if strings.TrimSpace(values) == "" {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(values))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("values are not a JSON object")
+	}
+	var fields []field
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{name: token.(string), value: value})
+	}
+	return fields, nil
+}
+
+// marshalFields writes the columns back as a JSON object. Empty values are
+// kept as they were.
+func marshalFields(fields []field, values string) string {
+	if len(fields) == 0 && strings.TrimSpace(values) == "" {
+		return values
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(f.value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,514 @@
+package audit
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	pg_query "github.com/pganalyze/pg_query_go/v2"
+)
+
+// returningDriver adds a `RETURNING` clause to the audited writes of Postgres,
+// so that their ids can be read
+type returningDriver struct {
+	driver.Driver
+	audited    func(tableName string, action Action) bool
+	primaryKey func(ctx context.Context, tableName string) ([]string, error)
+	returnAll  bool
+}
+
+func (d *returningDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &returningConn{Conn: conn, audited: d.audited, primaryKey: d.primaryKey, returnAll: d.returnAll}, nil
+}
+
+type returningConn struct {
+	driver.Conn
+	audited    func(tableName string, action Action) bool
+	primaryKey func(ctx context.Context, tableName string) ([]string, error)
+	returnAll  bool
+}
+
+func (c *returningConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if conn, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return conn.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *returningConn) ResetSession(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.SessionResetter); ok {
+		return conn.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *returningConn) Ping(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.Pinger); ok {
+		return conn.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *returningConn) IsValid() bool {
+	if conn, ok := c.Conn.(driver.Validator); ok {
+		return conn.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue lets the driver convert args of its own types, such as
+// arrays, leaving the others to database/sql.
+func (c *returningConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if conn, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return conn.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *returningConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *returningConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	r, ok := c.withReturning(ctx, query)
+	if !ok {
+		return c.prepare(ctx, query)
+	}
+
+	stmt, err := c.prepare(ctx, r.query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &returningStmt{Stmt: stmt, returning: r}, nil
+}
+
+func (c *returningConn) prepare(ctx context.Context, query string) (driver.Stmt, error) {
+	if conn, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return conn.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *returningConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r, ok := c.withReturning(ctx, query)
+	if !ok {
+		return c.exec(ctx, query, args)
+	}
+
+	rows, err := c.query(ctx, r.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	returned, err := bufferRows(rows, r.primaryKey, r.visible)
+	if err != nil {
+		return nil, err
+	}
+
+	return returned.result(), nil
+}
+
+func (c *returningConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, ok := c.withReturning(ctx, query)
+	if !ok {
+		return c.query(ctx, query, args)
+	}
+
+	rows, err := c.query(ctx, r.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return bufferRows(rows, r.primaryKey, r.visible)
+}
+
+// withReturning rewrites the query with the primary key of its table.
+func (c *returningConn) withReturning(ctx context.Context, query string) (returning, bool) {
+	return withReturning(query, c.returnAll, c.audited, func(tableName string) ([]string, error) {
+		return c.primaryKey(ctx, tableName)
+	})
+}
+
+func (c *returningConn) exec(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch conn := c.Conn.(type) {
+	case driver.ExecerContext:
+		return conn.ExecContext(ctx, query, args)
+	case driver.Execer:
+		vals, err := namedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Exec(query, vals)
+	default:
+		return nil, driver.ErrSkip
+	}
+}
+
+func (c *returningConn) query(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch conn := c.Conn.(type) {
+	case driver.QueryerContext:
+		return conn.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		vals, err := namedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Query(query, vals)
+	default:
+		return nil, driver.ErrSkip
+	}
+}
+
+type returningStmt struct {
+	driver.Stmt
+	returning
+}
+
+func (s *returningStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows, err := s.Stmt.Query(args)
+	if err != nil {
+		return nil, err
+	}
+
+	returned, err := bufferRows(rows, s.returning.primaryKey, s.visible)
+	if err != nil {
+		return nil, err
+	}
+
+	return returned.result(), nil
+}
+
+func (s *returningStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.Stmt.Query(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return bufferRows(rows, s.returning.primaryKey, s.visible)
+}
+
+func (s *returningStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	rows, err := s.query(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	returned, err := bufferRows(rows, s.returning.primaryKey, s.visible)
+	if err != nil {
+		return nil, err
+	}
+
+	return returned.result(), nil
+}
+
+func (s *returningStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.query(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return bufferRows(rows, s.returning.primaryKey, s.visible)
+}
+
+func (s *returningStmt) query(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if stmt, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return stmt.QueryContext(ctx, args)
+	}
+
+	vals, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(vals)
+}
+
+// returnedRows holds the rows a statement returned, read ahead of the
+// application
+type returnedRows struct {
+	columns []string
+	all     []string
+	values  [][]driver.Value
+	ids     []string
+	pos     int
+}
+
+// bufferRows reads every row, keeping the first visible columns for the
+// application
+func bufferRows(rows driver.Rows, primaryKey []string, visible int) (*returnedRows, error) {
+	defer rows.Close()
+
+	columns := rows.Columns()
+	returned := &returnedRows{columns: columns, all: columns}
+	if visible >= 0 && visible <= len(columns) {
+		returned.columns = columns[:visible]
+	}
+
+	// prefer a column added by the auditor, which is never renamed
+	index := make(map[string]int, len(primaryKey))
+	for i, col := range columns {
+		for _, key := range primaryKey {
+			if col == key {
+				index[key] = i
+			}
+		}
+	}
+
+	for {
+		dest := make([]driver.Value, len(columns))
+		err := rows.Next(dest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i, val := range dest {
+			// drivers may reuse their buffers between rows
+			if b, ok := val.([]byte); ok {
+				dest[i] = append([]byte(nil), b...)
+			}
+		}
+
+		key := make(map[string]string, len(index))
+		for col, i := range index {
+			key[col] = valueString(dest[i])
+		}
+		if id, ok := rowID(key, primaryKey); ok {
+			returned.ids = append(returned.ids, id)
+		}
+		returned.values = append(returned.values, dest)
+	}
+
+	return returned, nil
+}
+
+func (r *returnedRows) Columns() []string {
+	return r.columns
+}
+
+func (r *returnedRows) Close() error {
+	return nil
+}
+
+func (r *returnedRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.pos])
+	r.pos++
+
+	return nil
+}
+
+func (r *returnedRows) result() driver.Result {
+	return returnedResult{rows: r}
+}
+
+// returnedResult is the result of a statement run through Exec, with the rows
+// read from its `RETURNING` clause.
+type returnedResult struct {
+	rows *returnedRows
+}
+
+func (r returnedResult) LastInsertId() (int64, error) {
+	if len(r.rows.ids) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(r.rows.ids[0], 10, 64)
+}
+
+func (r returnedResult) RowsAffected() (int64, error) {
+	return int64(len(r.rows.values)), nil
+}
+
+// returned gives the rows read by the returningDriver for a statement, whether it
+// was run through Exec or Query.
+func returned(result driver.Result, rows driver.Rows) *returnedRows {
+	if r, ok := result.(returnedResult); ok {
+		return r.rows
+	}
+	if r, ok := rows.(*returnedRows); ok {
+		return r
+	}
+	return nil
+}
+
+// returnedIDs gives the ids read by the returningDriver for an INSERT.
+func returnedIDs(result driver.Result, rows driver.Rows) []string {
+	if r := returned(result, rows); r != nil {
+		return r.ids
+	}
+	return nil
+}
+
+// returnedValues gives every returned row as a JSON object
+func returnedValues(result driver.Result, rows driver.Rows, primaryKey []string) ([]row, error) {
+	r := returned(result, rows)
+	if r == nil {
+		return nil, nil
+	}
+
+	var out []row
+	for _, values := range r.values {
+		toString := make(map[string]string, len(r.all))
+		for i, col := range r.all {
+			toString[col] = valueString(values[i])
+		}
+
+		rr, err := newRow(toString, primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		if rr.id == "" {
+			continue
+		}
+		out = append(out, rr)
+	}
+
+	return out, nil
+}
+
+// valueString formats a value from the driver the way it reads as text.
+func valueString(val driver.Value) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// returning is a query rewritten with a `RETURNING` clause
+type returning struct {
+	query      string
+	primaryKey []string
+	visible    int
+}
+
+// withReturning adds the primary key, or every column with returnAll, to the
+// `RETURNING` clause of an audited write
+func withReturning(query string, returnAll bool, audited func(tableName string, action Action) bool, primaryKey func(tableName string) ([]string, error)) (returning, bool) {
+	tree, err := pg_query.Parse(query)
+	if err != nil || len(tree.Stmts) != 1 {
+		return returning{}, false
+	}
+
+	var list *[]*pg_query.Node
+	var relation *pg_query.RangeVar
+	var action Action
+	joined := false
+	switch stmt := tree.Stmts[0].Stmt; {
+	case stmt.GetInsertStmt() != nil:
+		list = &stmt.GetInsertStmt().ReturningList
+		relation = stmt.GetInsertStmt().GetRelation()
+		action = Insert
+	case returnAll && stmt.GetUpdateStmt() != nil:
+		list = &stmt.GetUpdateStmt().ReturningList
+		relation = stmt.GetUpdateStmt().GetRelation()
+		action = Update
+		joined = len(stmt.GetUpdateStmt().GetFromClause()) > 0
+	default:
+		return returning{}, false
+	}
+	tableName := relationIdentity(relation)
+	if audited != nil && !audited(tableName, action) {
+		return returning{}, false
+	}
+
+	r := returning{query: query, visible: -1}
+	r.primaryKey, err = primaryKey(tableName)
+	if err != nil {
+		// such as a table created in a transaction that is not committed yet,
+		// which the auditor cannot see
+		log.Printf("audit: primary key of %s not returned: %v", tableName, err)
+		return returning{}, false
+	}
+	if len(r.primaryKey) == 0 {
+		// a table without a primary key is recorded without an id
+		return returning{}, false
+	}
+
+	returned := make(map[string]bool)
+	for _, node := range *list {
+		target := node.GetResTarget()
+		if target == nil {
+			continue
+		}
+
+		fields := target.Val.GetColumnRef().GetFields()
+		if len(fields) == 0 {
+			continue
+		}
+		last := fields[len(fields)-1]
+		if last.GetAStar() != nil {
+			switch {
+			case len(fields) == 2 && fields[0].GetString_().GetStr() == relationRef(relation):
+				return r, true
+			case len(fields) == 1 && !joined:
+				return r, true
+			case len(fields) == 1:
+				// the columns of the joined tables cannot be told apart, so
+				// the rows are selected again instead
+				return returning{}, false
+			}
+		}
+		if target.Name == "" || target.Name == last.GetString_().GetStr() {
+			returned[last.GetString_().GetStr()] = true
+		}
+	}
+
+	var columns [][]*pg_query.Node
+	switch {
+	case returnAll && joined:
+		columns = append(columns, []*pg_query.Node{pg_query.MakeStrNode(relationRef(relation)), pg_query.MakeAStarNode()})
+	case returnAll:
+		columns = append(columns, []*pg_query.Node{pg_query.MakeAStarNode()})
+	default:
+		for _, col := range r.primaryKey {
+			if !returned[col] {
+				columns = append(columns, []*pg_query.Node{pg_query.MakeStrNode(col)})
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return r, true
+	}
+
+	r.visible = len(*list)
+	for _, fields := range columns {
+		*list = append(*list, pg_query.MakeResTargetNodeWithVal(pg_query.MakeColumnRefNode(fields, 0), 0))
+	}
+
+	r.query, err = pg_query.Deparse(tree)
+	if err != nil {
+		return returning{}, false
+	}
+
+	return r, true
+}
+
+func namedValues(named []driver.NamedValue) ([]driver.Value, error) {
+	vals := make([]driver.Value, len(named))
+	for i, arg := range named {
+		if arg.Name != "" {
+			return nil, ErrInvalidQuery
+		}
+		vals[i] = arg.Value
+	}
+	return vals, nil
+}
@@ -0,0 +1,198 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoSigningKeys      = fmt.Errorf("no signing keys are given")
+	ErrUnknownSigningKey  = fmt.Errorf("signing key is not known")
+	ErrSigningNotSet      = fmt.Errorf("no signing keys are set")
+	ErrShortSigningKey    = fmt.Errorf("signing key is shorter than 16 bytes")
+	ErrInvalidSigningKeys = fmt.Errorf("signing keys are not in the form id=base64key")
+	ErrNotSigned          = fmt.Errorf("audit event is not signed")
+	ErrSignatureMismatch  = fmt.Errorf("audit event does not match its signature")
+)
+
+// minSigningKey is the shortest signing key taken, in bytes.
+const minSigningKey = 16
+
+// KeyProvider gives the keys events are signed with
+type KeyProvider interface {
+	// CurrentKey is the key new events are signed with, and its id.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key is the key of an id. It returns ErrUnknownSigningKey for an id it
+	// does not know.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// SignatureError is a record of the audit table whose signature does not hold,
+// as found by Auditor.VerifySignatures.
+type SignatureError struct {
+	ID     int64
+	KeyID  string
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("audit record %d signed with key %q: %s", e.ID, e.KeyID, e.Reason)
+}
+
+// KeyRing is a fixed set of keys, the last of which is current. It gives the
+// keys of WithSigning, or the key encryption keys of a KeyWrapper.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ParseKeys reads `id=base64key` entries, the last being the current key
+func ParseKeys(s string) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			i := strings.IndexByte(entry, '=')
+			if i <= 0 {
+				return nil, ErrInvalidSigningKeys
+			}
+			id := strings.TrimSpace(entry[:i])
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("signing key %q: %w", id, err)
+			}
+			if len(key) < minSigningKey {
+				return nil, fmt.Errorf("signing key %q: %w", id, ErrShortSigningKey)
+			}
+			ring.keys[id] = key
+			ring.current = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if ring.current == "" {
+		return nil, ErrNoSigningKeys
+	}
+
+	return ring, nil
+}
+
+// KeysFromFile reads a key ring from a file, as parsed by ParseKeys.
+func KeysFromFile(path string) (*KeyRing, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(string(b))
+}
+
+// KeysFromEnv reads a key ring from an environment variable, as parsed by
+// ParseKeys.
+func KeysFromEnv(name string) (*KeyRing, error) {
+	return ParseKeys(os.Getenv(name))
+}
+
+func (r *KeyRing) CurrentKey(_ context.Context) (string, []byte, error) {
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(_ context.Context, id string) ([]byte, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+// sign signs the events with the current key, when set up by WithSigning.
+func (s store) sign(ctx context.Context, events []Event) error {
+	if s.signingKeys == nil {
+		return nil
+	}
+
+	id, key, err := s.signingKeys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		events[i].KeyID = id
+		events[i].Signature = eventSignature(key, id, events[i])
+	}
+	return nil
+}
+
+// eventSignature is the HMAC-SHA256 of an event along with the id of the key
+// it is signed with.
+func eventSignature(key []byte, keyID string, ev Event) string {
+	canonical, _ := json.Marshal(append([]interface{}{keyID}, eventContent(ev)...))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature of an event, such as one read from a
+// file or a webhook, with the key it was signed with.
+func (a *Auditor) VerifySignature(ctx context.Context, ev Event) error {
+	if a.store.signingKeys == nil {
+		return ErrSigningNotSet
+	}
+	if ev.Signature == "" {
+		return ErrNotSigned
+	}
+
+	key, err := a.store.signingKeys.Key(ctx, ev.KeyID)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(eventSignature(key, ev.KeyID, ev)), []byte(ev.Signature)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// VerifySignatures checks the records of the audit table from id from to to, 0
+// for the last, and returns a *SignatureError for the first bad one
+func (a *Auditor) VerifySignatures(ctx context.Context, from, to int64) error {
+	if a.store.signingKeys == nil {
+		return ErrSigningNotSet
+	}
+	sink, ok := a.store.tableSink()
+	if !ok {
+		return ErrVerifyNotSupported
+	}
+
+	return sink.records(ctx, from, to, func(id int64, ev Event) error {
+		if ev.Signature == "" {
+			return &SignatureError{ID: id, Reason: "record is not signed"}
+		}
+		key, err := a.store.signingKeys.Key(ctx, ev.KeyID)
+		if err == ErrUnknownSigningKey {
+			return &SignatureError{ID: id, KeyID: ev.KeyID, Reason: "key is not known"}
+		}
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(eventSignature(key, ev.KeyID, ev)), []byte(ev.Signature)) {
+			return &SignatureError{ID: id, KeyID: ev.KeyID, Reason: "record does not match its signature"}
+		}
+		return nil
+	})
+}
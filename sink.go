@@ -0,0 +1,262 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoSink = fmt.Errorf("no sink is set to save audit events")
+
+// Sink saves audit events once they are built. The events of a statement are
+// given together, in the order of the rows they are for.
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+}
+
+// connSink is a Sink that can also write events on the connection of a
+// statement, as part of the transaction it is in.
+type connSink interface {
+	Sink
+	writeConn(ctx context.Context, conn *transactionConn, events []Event) error
+}
+
+// maxInsertRows is the most events inserted by a single statement, keeping
+// within the number of placeholders both databases take.
+const maxInsertRows = 500
+
+// auditColumns is the number of columns an event is inserted with, and
+// hashColumns and signatureColumns the number added for the hash chain and the
+// signature.
+const (
+	auditColumns     = 11
+	hashColumns      = 2
+	signatureColumns = 2
+)
+
+// sqlSink writes events into the audit table
+type sqlSink struct {
+	db     *sql.DB
+	dbType string
+	table  string
+	insert string
+
+	// hashed also inserts the hash chain columns, and signed the signature
+	// columns.
+	hashed bool
+	signed bool
+
+	mu    sync.Mutex
+	stmts map[int]*sql.Stmt
+}
+
+func newSqlSink(db *sql.DB, dbType, table, insert string) *sqlSink {
+	return &sqlSink{db: db, dbType: dbType, table: table, insert: insert, stmts: make(map[int]*sql.Stmt)}
+}
+
+func (s *sqlSink) Write(ctx context.Context, events []Event) error {
+	if len(events) <= maxInsertRows {
+		stmt, err := s.prepared(ctx, len(events))
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, s.batchArgs(events)...)
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches(events, maxInsertRows) {
+		stmt, err := s.prepared(ctx, len(batch))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, s.batchArgs(batch)...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSink) writeConn(ctx context.Context, conn *transactionConn, events []Event) error {
+	for _, batch := range batches(events, maxInsertRows) {
+		if err := conn.exec(ctx, s.insertRows(len(batch)), s.batchArgs(batch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the prepared statements.
+func (s *sqlSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for rows, stmt := range s.stmts {
+		if e := stmt.Close(); err == nil {
+			err = e
+		}
+		delete(s.stmts, rows)
+	}
+	return err
+}
+
+// prepared returns the statement inserting the number of rows, preparing it the
+// first time.
+func (s *sqlSink) prepared(ctx context.Context, rows int) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stmt, ok := s.stmts[rows]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.PrepareContext(ctx, s.insertRows(rows))
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[rows] = stmt
+	return stmt, nil
+}
+
+// insertRows is the audit table insert for the number of rows at once.
+func (s *sqlSink) insertRows(rows int) string {
+	if rows == 1 && !s.hashed && !s.signed {
+		return s.insert
+	}
+
+	columns := s.insert[:strings.Index(s.insert, "VALUES")]
+	n := auditColumns
+	if s.hashed {
+		end := strings.LastIndex(columns, ")")
+		columns = columns[:end] + ", prev_hash, hash" + columns[end:]
+		n += hashColumns
+	}
+	if s.signed {
+		end := strings.LastIndex(columns, ")")
+		columns = columns[:end] + ", key_id, signature" + columns[end:]
+		n += signatureColumns
+	}
+
+	var b strings.Builder
+	b.WriteString(columns)
+	b.WriteString("VALUES")
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("(")
+		for col := 0; col < n; col++ {
+			if col > 0 {
+				b.WriteString(",")
+			}
+			if s.dbType == PostgresDB {
+				b.WriteString("$" + strconv.Itoa(i*n+col+1))
+			} else {
+				b.WriteString("?")
+			}
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// batches splits the events into batches of at most size events.
+func batches(events []Event, size int) [][]Event {
+	var out [][]Event
+	for len(events) > size {
+		out = append(out, events[:size])
+		events = events[size:]
+	}
+	if len(events) > 0 {
+		out = append(out, events)
+	}
+	return out
+}
+
+// batchArgs are the values of the events in the order of the audit table insert.
+func (s *sqlSink) batchArgs(events []Event) []interface{} {
+	args := make([]interface{}, 0, len(events)*(auditColumns+hashColumns+signatureColumns))
+	for _, ev := range events {
+		if s.dbType == MysqlDB && (s.hashed || s.signed) {
+			// a datetime column rounds to the second, which would not be the
+			// second hashed
+			ev.CreatedAt = ev.CreatedAt.Truncate(time.Second)
+		}
+		args = append(args, eventArgs(ev)...)
+		if s.hashed {
+			args = append(args, ev.PrevHash, ev.Hash)
+		}
+		if s.signed {
+			args = append(args, ev.KeyID, ev.Signature)
+		}
+	}
+	return args
+}
+
+// eventArgs are the values of an event in the order of the audit table insert.
+func eventArgs(ev Event) []interface{} {
+	return []interface{}{
+		ev.ActorID,
+		ev.TableRowID,
+		ev.Table,
+		ev.Action,
+		ev.OldValues,
+		ev.NewValues,
+		ev.HTTPMethod,
+		ev.URL,
+		ev.IPAddress,
+		ev.UserAgent,
+		ev.CreatedAt,
+	}
+}
+
+// write redacts, encrypts and signs events, then saves them
+func (s store) write(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	s.redact(events)
+	if err := s.encrypt(ctx, events); err != nil {
+		return err
+	}
+	if err := s.sign(ctx, events); err != nil {
+		return err
+	}
+	if st, ok := ctx.Value(statementKey{}).(statement); ok && st.conn.tx != nil {
+		st.conn.tx.events = append(st.conn.tx.events, events...)
+		return nil
+	}
+
+	return s.save(ctx, events)
+}
+
+// tableSink is the sink inserting into the audit table, if events are saved
+// there.
+func (s store) tableSink() (*sqlSink, bool) {
+	if chain, ok := s.sink.(*chainSink); ok {
+		sink, ok := chain.sink.(*sqlSink)
+		return sink, ok
+	}
+	sink, ok := s.sink.(*sqlSink)
+	return sink, ok
+}
+
+// save gives the events to the queue if there is one, or to the sink.
+func (s store) save(ctx context.Context, events []Event) error {
+	if s.queue != nil {
+		return s.queue.Write(ctx, events)
+	}
+	if s.sink == nil {
+		return ErrNoSink
+	}
+	return s.sink.Write(ctx, events)
+}
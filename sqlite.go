@@ -0,0 +1,448 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/blastrain/vitess-sqlparser/sqlparser"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrSqliteParameters is given for a statement with named or numbered
+// parameters, as their arguments reach the hooks without their names.
+var ErrSqliteParameters = fmt.Errorf("named and numbered parameters cannot be audited on sqlite, use ? instead")
+
+// ErrSqliteSyntax is reported for a statement the MySQL grammar cannot read,
+// such as one with `RETURNING`. The statement runs without being audited.
+var ErrSqliteSyntax = fmt.Errorf("sqlite statement cannot be parsed, it is not audited")
+
+// SqliteParser parses SQLite with the MySQL grammar
+type SqliteParser struct {
+	*MysqlParser
+
+	// rowids caches the column each table names its rowid by, if any.
+	rowids keyCache
+}
+
+func (p *SqliteParser) getTableName(query string) (tableName string, err error) {
+	tableName, err = p.MysqlParser.getTableName(sqliteQuery(query))
+	return tableName, sqliteSyntax(query, err)
+}
+
+// sqliteSyntax tells a statement the parser cannot read apart from a write
+// after WITH, which is refused before it is parsed.
+func sqliteSyntax(query string, err error) error {
+	if err == nil || firstKeyword(query) == "with" {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrSqliteSyntax, err)
+}
+
+func (p *SqliteParser) setEvent(ctx context.Context, s store, auditTableName string, event Event, tableName, query string, args []interface{}) (Event, error) {
+	if hasSqliteParameters(query) {
+		return Event{}, ErrSqliteParameters
+	}
+	return p.MysqlParser.setEvent(ctx, s, auditTableName, event, tableName, sqliteQuery(query), args)
+}
+
+// newEvents builds the events a statement is audited as. A statement over the
+// row limit is summarised as it was written.
+func (p *SqliteParser) newEvents(ctx context.Context, query string, args []interface{}, insertIDs []string, event Event) ([]Event, error) {
+	if event.WhereClause.truncated {
+		return p.MysqlParser.newEvents(ctx, query, args, insertIDs, event)
+	}
+	return p.MysqlParser.newEvents(ctx, sqliteQuery(query), args, insertIDs, event)
+}
+
+func (p *SqliteParser) setNewInsertValues(ctx context.Context, event Event, insertIDs []string, query string, args []interface{}) ([]Event, error) {
+	return p.MysqlParser.setNewInsertValues(ctx, event, insertIDs, sqliteQuery(query), args)
+}
+
+// getPrimaryKey reads the primary key columns of a table, in the order they are
+// declared in.
+func (p *SqliteParser) getPrimaryKey(ctx context.Context, s store, tableName string) ([]string, error) {
+	schema, name := splitTableName(tableName)
+	columns, err := sqliteCatalog(ctx, s, []string{"name"},
+		`SELECT name FROM pragma_table_info(?, ?) WHERE pk > 0 ORDER BY pk`, name, sqliteSchema(s, schema))
+	if err != nil {
+		return nil, err
+	}
+
+	var primaryKey []string
+	for _, column := range columns {
+		primaryKey = append(primaryKey, column["name"])
+	}
+	return primaryKey, nil
+}
+
+// sqliteUniqueKeys reads the columns of the table's primary key and unique
+// indexes.
+func sqliteUniqueKeys(ctx context.Context, s store, table sqlparser.TableName) ([][]string, error) {
+	schema := sqliteSchema(s, table.Qualifier.String())
+	name := table.Name.String()
+
+	var keys [][]string
+	columns, err := sqliteCatalog(ctx, s, []string{"name"},
+		`SELECT name FROM pragma_table_info(?, ?) WHERE pk > 0 ORDER BY pk`, name, schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) > 0 {
+		keys = append(keys, nil)
+		for _, column := range columns {
+			keys[0] = append(keys[0], column["name"])
+		}
+	}
+
+	// the index SQLite creates for a primary key is already covered above
+	columns, err = sqliteCatalog(ctx, s, []string{"index_name", "column_name"},
+		`SELECT il.name AS index_name, ii.name AS column_name
+		FROM pragma_index_list(?, ?) AS il, pragma_index_info(il.name, ?) AS ii
+		WHERE il."unique" = 1 AND il.origin <> 'pk'
+		ORDER BY il.name, ii.seqno`, name, schema, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var last string
+	for i, column := range columns {
+		if i == 0 || column["index_name"] != last {
+			keys = append(keys, nil)
+			last = column["index_name"]
+		}
+		keys[len(keys)-1] = append(keys[len(keys)-1], column["column_name"])
+	}
+
+	return keys, nil
+}
+
+// insertIDs gives the ids of the rows an INSERT added
+func (p *SqliteParser) insertIDs(ctx context.Context, s store, event Event, result driver.Result) ([]string, error) {
+	column, err := p.rowidColumn(ctx, s, event.Table)
+	if err != nil || column == "" {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	// rows updated by an upsert are counted as affected, but take no new rowid
+	if event.WhereClause.upsert == upsertUpdate {
+		for _, conflict := range event.WhereClause.conflicts {
+			if conflict != nil {
+				rowsAffected--
+			}
+		}
+	}
+
+	var ids []string
+	for i := rowsAffected - 1; id > 0 && i >= 0; i-- {
+		ids = append(ids, strconv.FormatInt(id-i, 10))
+	}
+
+	return ids, nil
+}
+
+// rowidColumn gives the column a table names its rowid by, which is a single
+// INTEGER PRIMARY KEY column. It is empty for other tables.
+func (p *SqliteParser) rowidColumn(ctx context.Context, s store, tableName string) (string, error) {
+	if keys, ok := p.rowids.get(tableName); ok {
+		if len(keys) == 0 {
+			return "", nil
+		}
+		return keys[0][0], nil
+	}
+
+	schema, name := splitTableName(tableName)
+	columns, err := sqliteCatalog(ctx, s, []string{"name", "type"},
+		`SELECT name, type FROM pragma_table_info(?, ?) WHERE pk > 0`, name, sqliteSchema(s, schema))
+	if err != nil {
+		return "", err
+	}
+
+	var keys [][]string
+	if len(columns) == 1 && strings.EqualFold(columns[0]["type"], "integer") {
+		keys = [][]string{{columns[0]["name"]}}
+	}
+	p.rowids.set(tableName, keys)
+
+	if len(keys) == 0 {
+		return "", nil
+	}
+	return keys[0][0], nil
+}
+
+// sqliteSchema gives the schema a table is in, which is the default one when it
+// is named without one.
+func sqliteSchema(s store, schema string) string {
+	if schema == "" {
+		return s.defaultSchema
+	}
+	return schema
+}
+
+// sqliteCatalog reads a table pragma
+func sqliteCatalog(ctx context.Context, s store, columns []string, query string, args ...interface{}) ([]map[string]string, error) {
+	var rows []row
+	conn, ok, err := s.readConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rows, err = conn.queryRows(ctx, query, args, columns)
+	} else {
+		rows, err = sqliteRows(ctx, s.internal, query, args, columns)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]map[string]string, len(rows))
+	for i, r := range rows {
+		values[i] = r.key
+	}
+	return values, nil
+}
+
+func sqliteRows(ctx context.Context, db *sql.DB, query string, args []interface{}, columns []string) ([]row, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRows(rows, columns)
+}
+
+// sqliteToken is a piece of a SQLite statement. Words are keywords and
+// identifiers that are not quoted, while spaces also include comments.
+type sqliteToken struct {
+	text  string
+	word  bool
+	space bool
+}
+
+// sqliteQuery rewrites the syntax only SQLite has into the MySQL grammar
+func sqliteQuery(query string) string {
+	tokens := sqliteTokens(query)
+
+	next := func(i int) int {
+		for i++; i < len(tokens); i++ {
+			if !tokens[i].space {
+				return i
+			}
+		}
+		return -1
+	}
+	keyword := func(i int, keywords ...string) bool {
+		if i < 0 || !tokens[i].word {
+			return false
+		}
+		for _, kw := range keywords {
+			if strings.EqualFold(tokens[i].text, kw) {
+				return true
+			}
+		}
+		return false
+	}
+	drop := func(from, to int) {
+		for i := from; i <= to; i++ {
+			tokens[i].text = ""
+		}
+	}
+
+	first := next(-1)
+	if or := next(first); keyword(first, "insert", "update") && keyword(or, "or") {
+		resolution := next(or)
+		switch {
+		case keyword(first, "insert") && keyword(resolution, "replace"):
+			tokens[first].text = "REPLACE"
+		case keyword(first, "insert") && keyword(resolution, "ignore"):
+			tokens[first].text = "INSERT IGNORE"
+		}
+		if resolution > 0 {
+			drop(first+1, resolution)
+		}
+	}
+
+	depth := 0
+	for i := first; keyword(first, "insert") && i >= 0; i = next(i) {
+		switch tokens[i].text {
+		case "(":
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		conflict := next(i)
+		if depth > 0 || !keyword(i, "on") || !keyword(conflict, "conflict") {
+			continue
+		}
+
+		do := next(conflict)
+		if do >= 0 && tokens[do].text == "(" {
+			for open := 0; do >= 0; do = next(do) {
+				if tokens[do].text == "(" {
+					open++
+				} else if tokens[do].text == ")" {
+					open--
+				}
+				if open == 0 {
+					break
+				}
+			}
+			if do >= 0 {
+				do = next(do)
+			}
+		}
+		if !keyword(do, "do") {
+			break
+		}
+
+		action := next(do)
+		switch {
+		case keyword(action, "nothing"):
+			drop(i, action)
+			if keyword(first, "insert") {
+				tokens[first].text = "INSERT IGNORE"
+			}
+		case keyword(action, "update") && keyword(next(action), "set"):
+			drop(i, next(action))
+			tokens[i].text = "ON DUPLICATE KEY UPDATE"
+			for j := next(action); j >= 0; j = next(j) {
+				dot := next(j)
+				column := next(dot)
+				if !keyword(j, "excluded") || dot < 0 || tokens[dot].text != "." || column < 0 || tokens[column].space {
+					continue
+				}
+				tokens[j].text = "VALUES(" + tokens[column].text + ")"
+				drop(j+1, column)
+				j = column
+			}
+		}
+		break
+	}
+
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString(token.text)
+	}
+	return b.String()
+}
+
+// hasSqliteParameters tells whether a statement has `:name`, `@name`, `$name`
+// or `?NNN` parameters, rather than only `?`.
+func hasSqliteParameters(query string) bool {
+	tokens := sqliteTokens(query)
+	for i, token := range tokens {
+		if token.word && strings.HasPrefix(token.text, "$") {
+			return true
+		}
+		if i+1 >= len(tokens) || tokens[i+1].space || tokens[i+1].text == "" {
+			continue
+		}
+		following := tokens[i+1].text[0]
+		switch token.text {
+		case ":", "@":
+			if tokens[i+1].word {
+				return true
+			}
+		case "?":
+			if '0' <= following && following <= '9' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sqliteTokens splits a statement into words, quoted names, spaces and
+// characters
+func sqliteTokens(query string) []sqliteToken {
+	var tokens []sqliteToken
+	for i := 0; i < len(query); {
+		token := sqliteToken{}
+		end := i + 1
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end = quotedEnd(query, i, c)
+			if c == '"' && end > i+1 && query[end-1] == '"' {
+				token.text = backtickQuote(strings.ReplaceAll(query[i+1:end-1], `""`, `"`))
+			}
+		case c == '[':
+			if j := strings.IndexByte(query[i:], ']'); j > 0 {
+				end = i + j + 1
+				token.text = backtickQuote(query[i+1 : end-1])
+			} else {
+				end = len(query)
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			end = len(query)
+			if j := strings.IndexByte(query[i:], '\n'); j >= 0 {
+				end = i + j + 1
+			}
+			token.space = true
+		case strings.HasPrefix(query[i:], "/*"):
+			end = len(query)
+			if j := strings.Index(query[i+2:], "*/"); j >= 0 {
+				end = i + 2 + j + 2
+			}
+			token.space = true
+		case unicode.IsSpace(rune(c)):
+			for end < len(query) && unicode.IsSpace(rune(query[end])) {
+				end++
+			}
+			token.space = true
+		case isWordByte(c) && !('0' <= c && c <= '9'):
+			for end < len(query) && isWordByte(query[end]) {
+				end++
+			}
+			token.word = true
+		}
+
+		if token.text == "" {
+			token.text = query[i:end]
+		}
+		tokens = append(tokens, token)
+		i = end
+	}
+
+	return tokens
+}
+
+// quotedEnd gives the end of a string or identifier starting at i, where a
+// doubled quote stands for the quote itself.
+func quotedEnd(query string, i int, quote byte) int {
+	for j := i + 1; j < len(query); j++ {
+		if query[j] != quote {
+			continue
+		}
+		if j+1 < len(query) && query[j+1] == quote {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(query)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func backtickQuote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
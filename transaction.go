@@ -0,0 +1,467 @@
+package audit
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+)
+
+var ErrAuditNotSaved = fmt.Errorf("transaction committed but its audit was not saved")
+
+type statementKey struct{}
+
+// statement is the connection a statement runs on, as passed to the hooks.
+type statement struct {
+	conn *transactionConn
+}
+
+// readConn is the connection old values are read on, if it is the statement's
+func (s store) readConn(ctx context.Context) (*transactionConn, bool, error) {
+	st, ok := ctx.Value(statementKey{}).(statement)
+	if !ok || !(s.consistentPreImage || s.dbType == SqliteDB) {
+		return nil, false, nil
+	}
+	if s.consistentPreImage && st.conn.tx == nil {
+		if err := st.conn.beginImplicit(ctx); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return st.conn, true, nil
+}
+
+// lockRows tells whether old values are read with `FOR UPDATE`
+func (s store) lockRows() bool {
+	return s.consistentPreImage && s.dbType != SqliteDB
+}
+
+// transactionDriver holds the audit events of a transaction until it ends
+type transactionDriver struct {
+	driver.Driver
+	auditor *Auditor
+}
+
+func (d *transactionDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transactionConn{Conn: conn, auditor: d.auditor}, nil
+}
+
+type transactionConn struct {
+	driver.Conn
+	auditor *Auditor
+
+	// tx is the transaction the connection is in, if any.
+	tx *auditTx
+
+	// implicit is the transaction begun by the auditor for a single statement.
+	implicit *transaction
+}
+
+func (c *transactionConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *transactionConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.begin(ctx, opts)
+}
+
+func (c *transactionConn) begin(ctx context.Context, opts driver.TxOptions) (*transaction, error) {
+	var tx driver.Tx
+	var err error
+	if conn, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = conn.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.tx = &auditTx{}
+	return &transaction{Tx: tx, conn: c, audit: c.tx}, nil
+}
+
+func (c *transactionConn) ResetSession(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.SessionResetter); ok {
+		return conn.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *transactionConn) Ping(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.Pinger); ok {
+		return conn.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *transactionConn) IsValid() bool {
+	if conn, ok := c.Conn.(driver.Validator); ok {
+		return conn.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue lets the driver convert args of its own types, such as
+// arrays, leaving the others to database/sql.
+func (c *transactionConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if conn, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return conn.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *transactionConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *transactionConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transactionStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *transactionConn) prepare(ctx context.Context, query string) (driver.Stmt, error) {
+	if conn, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return conn.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *transactionConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	result, err := conn.ExecContext(c.withStatement(ctx), query, args)
+	return result, c.endImplicit(err)
+}
+
+func (c *transactionConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	rows, err := conn.QueryContext(c.withStatement(ctx), query, args)
+	return c.endImplicitRows(rows, err)
+}
+
+// withStatement passes the connection on to the hooks.
+func (c *transactionConn) withStatement(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statementKey{}, statement{conn: c})
+}
+
+// beginImplicit begins a transaction for the statement about to run, which
+// ends with it.
+func (c *transactionConn) beginImplicit(ctx context.Context) error {
+	tx, err := c.begin(ctx, driver.TxOptions{})
+	if err != nil {
+		return err
+	}
+	c.implicit = tx
+	return nil
+}
+
+// endImplicit commits the transaction begun for a statement, or rolls it back
+// if the statement failed.
+func (c *transactionConn) endImplicit(err error) error {
+	tx := c.implicit
+	if tx == nil {
+		return err
+	}
+	c.implicit = nil
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// endImplicitRows ends the transaction begun for a statement once its rows are
+// closed, so that the rows it locked stay locked until then.
+func (c *transactionConn) endImplicitRows(rows driver.Rows, err error) (driver.Rows, error) {
+	tx := c.implicit
+	if tx == nil {
+		return rows, err
+	}
+	if err != nil {
+		return nil, c.endImplicit(err)
+	}
+	c.implicit = nil
+
+	return &implicitRows{Rows: rows, tx: tx}, nil
+}
+
+// implicitRows are the rows of a statement run in a transaction of its own.
+type implicitRows struct {
+	driver.Rows
+	tx  *transaction
+	err error
+}
+
+func (r *implicitRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *implicitRows) Close() error {
+	err := r.Rows.Close()
+	if r.tx == nil {
+		return err
+	}
+	tx := r.tx
+	r.tx = nil
+
+	if err != nil || r.err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// exec runs a statement on the connection itself, so that it is part of the
+// transaction the connection is in.
+func (c *transactionConn) exec(ctx context.Context, query string, args []interface{}) error {
+	named, err := namedArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if conn, ok := c.Conn.(driver.ExecerContext); ok {
+		_, err := conn.ExecContext(ctx, query, named)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if stmt, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = stmt.ExecContext(ctx, named)
+		return err
+	}
+
+	vals, err := namedValues(named)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(vals)
+	return err
+}
+
+// queryRows reads rows on the connection itself, so that they are read in the
+// transaction the connection is in.
+func (c *transactionConn) queryRows(ctx context.Context, query string, args []interface{}, primaryKey []string) ([]row, error) {
+	named, err := namedArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	if conn, ok := c.Conn.(driver.QueryerContext); ok {
+		rows, err = conn.QueryContext(ctx, query, named)
+	}
+	if rows == nil && (err == nil || err == driver.ErrSkip) {
+		rows, err = c.queryPrepared(ctx, query, named)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := rows.Columns()
+	var out []row
+	for {
+		dest := make([]driver.Value, len(columns))
+		err := rows.Next(dest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]string, len(columns))
+		for i, col := range columns {
+			values[col] = valueString(dest[i])
+		}
+		r, err := newRow(values, primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+// queryPrepared reads rows through a prepared statement, for drivers that only
+// take args that way. The statement is closed along with the rows.
+func (c *transactionConn) queryPrepared(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	if s, ok := stmt.(driver.StmtQueryContext); ok {
+		rows, err = s.QueryContext(ctx, args)
+	} else {
+		var vals []driver.Value
+		vals, err = namedValues(args)
+		if err == nil {
+			rows, err = stmt.Query(vals)
+		}
+	}
+	if err != nil {
+		_ = stmt.Close()
+		return nil, err
+	}
+
+	return &stmtRows{Rows: rows, stmt: stmt}, nil
+}
+
+type stmtRows struct {
+	driver.Rows
+	stmt driver.Stmt
+}
+
+func (r *stmtRows) Close() error {
+	err := r.Rows.Close()
+	if e := r.stmt.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// namedArgs converts the args of a statement into the values a driver takes.
+func namedArgs(args []interface{}) ([]driver.NamedValue, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		value, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return named, nil
+}
+
+type transactionStmt struct {
+	driver.Stmt
+	conn *transactionConn
+}
+
+func (s *transactionStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx = s.conn.withStatement(ctx)
+
+	var result driver.Result
+	var err error
+	if stmt, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = stmt.ExecContext(ctx, args)
+	} else {
+		var vals []driver.Value
+		vals, err = stmtValues(ctx, args)
+		if err == nil {
+			result, err = s.Stmt.Exec(vals)
+		}
+	}
+	return result, s.conn.endImplicit(err)
+}
+
+func (s *transactionStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx = s.conn.withStatement(ctx)
+
+	var rows driver.Rows
+	var err error
+	if stmt, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = stmt.QueryContext(ctx, args)
+	} else {
+		var vals []driver.Value
+		vals, err = stmtValues(ctx, args)
+		if err == nil {
+			rows, err = s.Stmt.Query(vals)
+		}
+	}
+	return s.conn.endImplicitRows(rows, err)
+}
+
+// stmtValues gives the args of a statement that takes no context, unless the
+// context is already done.
+func stmtValues(ctx context.Context, args []driver.NamedValue) ([]driver.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return namedValues(args)
+}
+
+// transaction saves the audit events held for it once it ends.
+type transaction struct {
+	driver.Tx
+	conn  *transactionConn
+	audit *auditTx
+}
+
+// Commit saves the audit events of the transaction, in it with
+// WithSameTransaction
+func (t *transaction) Commit() error {
+	defer t.end()
+
+	ctx := context.Background()
+	events := t.audit.events
+	if sink, ok := t.conn.auditor.sink.(connSink); ok && t.conn.auditor.sameTransaction && t.conn.auditor.auditDB == nil {
+		if err := sink.writeConn(ctx, t.conn, events); err != nil {
+			_ = t.Tx.Rollback()
+			return err
+		}
+		return t.Tx.Commit()
+	}
+
+	if err := t.Tx.Commit(); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	// the transaction is committed, so the error is not the application's
+	if err := t.conn.auditor.save(ctx, events); err != nil {
+		t.conn.auditor.reportError(fmt.Errorf("%w: %v", ErrAuditNotSaved, err), events)
+	}
+	return nil
+}
+
+// Rollback drops the audit rows of the transaction.
+func (t *transaction) Rollback() error {
+	defer t.end()
+
+	return t.Tx.Rollback()
+}
+
+func (t *transaction) end() {
+	if t.conn.tx == t.audit {
+		t.conn.tx = nil
+	}
+}
+
+// auditTx holds the audit events of a transaction until it ends.
+type auditTx struct {
+	events []Event
+}
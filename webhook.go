@@ -0,0 +1,350 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoWebhookURL = fmt.Errorf("webhook url is not set")
+
+// WebhookConfig sets up a sink posting events to an HTTP endpoint.
+type WebhookConfig struct {
+	// URL is the endpoint events are posted to.
+	URL string
+	// Client sends the requests. Defaults to a client with a ten second
+	// timeout.
+	Client *http.Client
+	// Header is added to every request.
+	Header http.Header
+
+	// Secret signs every payload, sent as `sha256=<hex>` in the
+	// SignatureHeader.
+	Secret []byte
+	// SignatureHeader is the header the signature is sent in. Defaults to
+	// `X-Audit-Signature`.
+	SignatureHeader string
+
+	// Filter picks the events that are posted. Defaults to every event.
+	Filter func(Event) bool
+	// BatchSize is the most events posted together. Defaults to 100.
+	BatchSize int
+
+	// MaxRetries is the number of times a payload is sent again after a
+	// failure. Defaults to 5.
+	MaxRetries int
+	// MinBackoff is the wait before the first retry, which doubles for every
+	// retry after it up to MaxBackoff. Defaults to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// SpoolDir keeps undelivered payloads for Replay, and rejected ones as dead
+	// letters.
+	SpoolDir string
+}
+
+const (
+	defaultWebhookTimeout  = 10 * time.Second
+	defaultSignatureHeader = "X-Audit-Signature"
+	defaultMaxRetries      = 5
+	defaultMinBackoff      = 100 * time.Millisecond
+	defaultMaxBackoff      = 10 * time.Second
+
+	// deliveryHeader identifies a payload, which stays the same when it is
+	// retried or replayed so that the endpoint can leave out repeats.
+	deliveryHeader = "X-Audit-Delivery"
+
+	spoolExt      = ".json"
+	deadLetterExt = ".dead"
+)
+
+// WebhookSink posts events to an HTTP endpoint. Use it behind WithQueue, as
+// retries hold up the write.
+type WebhookSink struct {
+	config WebhookConfig
+
+	// mu keeps Replay from sending a spooled payload twice.
+	mu sync.Mutex
+}
+
+// webhookError is a response the endpoint gave.
+type webhookError struct {
+	status int
+	body   string
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("webhook responded with %d: %s", e.status, e.body)
+}
+
+// retry tells whether the request may succeed when sent again.
+func (e *webhookError) retry() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// NewWebhookSink creates a sink posting to the endpoint. It is set on the
+// auditor with WithSink.
+func NewWebhookSink(config WebhookConfig) (*WebhookSink, error) {
+	if config.URL == "" {
+		return nil, ErrNoWebhookURL
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = defaultSignatureHeader
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.SpoolDir != "" {
+		if err := os.MkdirAll(config.SpoolDir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &WebhookSink{config: config}, nil
+}
+
+// Write posts the events in batches, spooling those that cannot be delivered
+func (s *WebhookSink) Write(ctx context.Context, events []Event) error {
+	var picked []Event
+	for _, ev := range events {
+		if s.config.Filter == nil || s.config.Filter(ev) {
+			picked = append(picked, ev)
+		}
+	}
+
+	for _, batch := range batches(picked, s.config.BatchSize) {
+		payload := make([]jsonEvent, len(batch))
+		for i, ev := range batch {
+			payload[i] = jsonEventOf(ev)
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		id := deliveryID(body)
+		err = s.deliver(ctx, id, body)
+		if err == nil {
+			continue
+		}
+		if s.config.SpoolDir == "" {
+			return err
+		}
+		ext := spoolExt
+		if rejected(err) {
+			ext = deadLetterExt
+		}
+		path, e := s.spool(id, body, ext)
+		if e != nil {
+			return fmt.Errorf("%v, and not spooled: %w", err, e)
+		}
+		log.Printf("audit: %d events spooled to %s: %v", len(batch), path, err)
+	}
+
+	return nil
+}
+
+// Replay sends the spooled payloads again, going on past those that fail
+func (s *WebhookSink) Replay(ctx context.Context) error {
+	if s.config.SpoolDir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.config.SpoolDir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var failed int
+	var first error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.replay(ctx, name); err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("%d spooled payloads not delivered: %w", failed, first)
+	}
+
+	return nil
+}
+
+func (s *WebhookSink) replay(ctx context.Context, name string) error {
+	path := filepath.Join(s.config.SpoolDir, name)
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	id := strings.TrimSuffix(name, spoolExt)
+	if i := strings.IndexByte(id, '-'); i >= 0 {
+		id = id[i+1:]
+	}
+	err = s.deliver(ctx, id, body)
+	if rejected(err) {
+		dead := strings.TrimSuffix(path, spoolExt) + deadLetterExt
+		if e := os.Rename(path, dead); e != nil {
+			return e
+		}
+		log.Printf("audit: spooled %s kept as a dead letter: %v", name, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rejected tells whether the endpoint refused a payload, which would be refused
+// again.
+func rejected(err error) bool {
+	e, ok := err.(*webhookError)
+	return ok && !e.retry()
+}
+
+// deliver posts a payload, retrying failures the endpoint may recover from.
+func (s *WebhookSink) deliver(ctx context.Context, id string, body []byte) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = s.post(ctx, id, body)
+		if err == nil {
+			return nil
+		}
+		if rejected(err) {
+			return err
+		}
+		if attempt >= s.config.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(s.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *WebhookSink) post(ctx context.Context, id string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range s.config.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(deliveryHeader, id)
+	if len(s.config.Secret) > 0 {
+		req.Header.Set(s.config.SignatureHeader, Signature(s.config.Secret, body))
+	}
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &webhookError{status: resp.StatusCode, body: string(message)}
+}
+
+// backoff is the wait before a retry, doubling with every attempt up to the
+// longest, with some jitter so that retries are spread out.
+func (s *WebhookSink) backoff(attempt int) time.Duration {
+	wait := s.config.MaxBackoff
+	if attempt < 32 {
+		if d := s.config.MinBackoff << uint(attempt); d > 0 && d < wait {
+			wait = d
+		}
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)+1))
+}
+
+// spool keeps a payload on disk, giving the path of its file. Files are named
+// after the time they were spooled, so that they sort in order, and the id of
+// their delivery.
+func (s *WebhookSink) spool(id string, body []byte, ext string) (string, error) {
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + id + ext
+	path := filepath.Join(s.config.SpoolDir, name)
+
+	// written under another name first, so that a partial file is never
+	// replayed
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// Signature is the HMAC-SHA256 signature of a webhook payload, as sent in the
+// signature header.
+func Signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryID identifies a payload by its content, so that a batch written
+// again, such as by a queue after an earlier batch failed, keeps its id.
+func deliveryID(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:16])
+}